@@ -6,6 +6,7 @@ import (
 	"strings"
 
 	"github.com/golang-jwt/jwt/v5"
+	echojwt "github.com/labstack/echo-jwt/v4"
 	"github.com/labstack/echo/v4"
 )
 
@@ -18,6 +19,7 @@ var (
 	whitelist      = map[string]map[string][]string{} // login => domain => path => struct{}
 	blacklist      = map[string]map[string][]string{}
 	fullaccess     = map[string]struct{}{}
+	roles          = map[string]map[string]struct{}{} // login => custom roles not tied to a service
 	serviceMapping = map[string]ACLElement{
 		"a1111":     {Domain: "", Path: "/"},
 		"status":    {Domain: "", Path: "/q"},
@@ -32,6 +34,13 @@ var (
 )
 
 func putACL(login string, service string) error {
+	if role, ok := strings.CutPrefix(service, "@"); ok {
+		if _, ok := roles[login]; !ok {
+			roles[login] = map[string]struct{}{}
+		}
+		roles[login][role] = struct{}{}
+		return nil
+	}
 	list := whitelist
 	if strings.HasPrefix(service, "-") {
 		list = blacklist
@@ -89,6 +98,18 @@ func checkACL(domain string, path string, login string) bool {
 	return true
 }
 
+// hasRole checks if the user has a custom role, users with full access have all roles
+func hasRole(login string, role string) bool {
+	if len(config.ACL) == 0 { // no acl loaded, allow all
+		return true
+	}
+	if _, ok := fullaccess[login]; ok {
+		return true
+	}
+	_, ok := roles[login][role]
+	return ok
+}
+
 func loadACL() error {
 	for login, services := range config.ACL {
 		if len(services) == 1 && services[0] == "*" {
@@ -104,22 +125,60 @@ func loadACL() error {
 	return nil
 }
 
+// userFromContext returns the JWT subject or empty string if the request is not authenticated
+func userFromContext(c echo.Context) string {
+	token, ok := c.Get("user").(*jwt.Token)
+	if !ok || token == nil || token.Claims == nil {
+		return ""
+	}
+	subject, err := token.Claims.GetSubject()
+	if err != nil {
+		return ""
+	}
+	return subject
+}
+
+// apiTokenLookup is where optionalUser looks for the login token, the API clients can send it as the API key
+const apiTokenLookup = "cookie:" + cookieName + ",header:Authorization:Bearer ,header:x-api-key"
+
+// optionalUser also checks the login token on the routes that skip the authentication, the clients without a valid
+// token are anonymous
+func optionalUser(c echo.Context) string {
+	if user := userFromContext(c); user != "" {
+		return user
+	}
+	extractors, err := echojwt.CreateExtractors(apiTokenLookup)
+	if err != nil {
+		log.Printf("Error creating token extractors: %s", err)
+		return ""
+	}
+	for _, extractor := range extractors {
+		values, err := extractor(c)
+		if err != nil {
+			continue
+		}
+		for _, v := range values {
+			token, err := parseToken(v)
+			if err != nil {
+				continue
+			}
+			if subject, err := token.Claims.GetSubject(); err == nil && subject != "" {
+				return subject
+			}
+		}
+	}
+	return ""
+}
+
 func aclMiddleware() echo.MiddlewareFunc {
 	return func(next echo.HandlerFunc) echo.HandlerFunc {
 		return func(c echo.Context) error {
-			token := c.Get("user")
-			if token != nil {
-				claims := token.(*jwt.Token).Claims
-				if claims != nil {
-					subject, err := claims.GetSubject()
-					if err == nil && subject != "" {
-						domain := strings.TrimSuffix(c.Request().Host, config.Domain)
-						path := c.Request().URL.Path
-						if !checkACL(domain, path, subject) {
-							log.Printf("ACL access denied for user %s to %s %s", subject, domain, path)
-							return echo.ErrForbidden
-						}
-					}
+			if subject := userFromContext(c); subject != "" {
+				domain := strings.TrimSuffix(c.Request().Host, config.Domain)
+				path := c.Request().URL.Path
+				if !checkACL(domain, path, subject) {
+					log.Printf("ACL access denied for user %s to %s %s", subject, domain, path)
+					return echo.ErrForbidden
 				}
 			}
 			return next(c)
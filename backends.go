@@ -0,0 +1,135 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"path/filepath"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/rkfg/authproxy/events"
+	"github.com/rkfg/authproxy/metrics"
+	"github.com/rkfg/authproxy/proxy"
+)
+
+type CacheRuleConfig struct {
+	Path  string   `yaml:"path" description:"Path pattern (path.Match syntax, patterns ending with / match by prefix)"`
+	TTL   int      `yaml:"ttl" description:"Time in seconds the cached response is considered fresh"`
+	Query []string `yaml:"query" description:"Query parameters that form the cache key, the requests with other parameters aren't cached"`
+}
+
+type BackendConfig struct {
+	Cache                 []CacheRuleConfig `yaml:"cache" description:"GET requests to cache"`
+	RetryAfter            int               `yaml:"retry_after" description:"Seconds before the maintenance page refreshes when the backend is down"`
+	ConnectTimeout        int               `yaml:"connect_timeout" description:"Connect timeout in seconds"`
+	ResponseHeaderTimeout int               `yaml:"response_header_timeout" description:"Timeout in seconds for the response headers after the request is sent"`
+	Retries               int               `yaml:"retries" description:"Number of retries for idempotent requests"`
+	RetryBackoff          int               `yaml:"retry_backoff" description:"Initial delay between retries in milliseconds, doubles every attempt"`
+	BreakerThreshold      int               `yaml:"breaker_threshold" description:"Consecutive failures to open the circuit breaker, 0 disables it"`
+	BreakerCooldown       int               `yaml:"breaker_cooldown" description:"Seconds before a probe request is let through the open breaker"`
+}
+
+type CacheConfig struct {
+	Dir          string `yaml:"dir" description:"Directory for the on-disk response cache, memory is used if empty"`
+	MaxEntrySize int64  `yaml:"max_entry_size" description:"Maximum size of a cached response"`
+	MaxMemory    int64  `yaml:"max_memory" description:"Maximum size of the in-memory cache per backend"`
+	MaxDisk      int64  `yaml:"max_disk" description:"Maximum size of the on-disk cache per backend, the least recently used entries are removed"`
+}
+
+// backendEvents connects the backends to the broker and metrics, set in main before the backends are created
+var backendEvents struct {
+	broker  *events.Broker
+	metrics chan<- metrics.MetricUpdate
+}
+
+// transports are shared between the backends with the same name so they have a common circuit breaker
+var transports = map[string]http.RoundTripper{}
+
+func newDomains() map[string]echo.MiddlewareFunc {
+	return map[string]echo.MiddlewareFunc{
+		"":               newBackend("sd", SD_URL, &proxy.Interceptor{Rules: sdRules()}),
+		"acestep.":       newBackend("acestep", AS10_URL, nil),
+		"as15.":          newBackend("as15", AS15_URL, nil),
+		"ovi.":           newBackend("ovi", OVI_URL, nil),
+		"cui.":           newBackend("cui", CUI_URL, nil),
+		"vlo.":           newBackend("vlo", VLO_URL, nil),
+		"/vote2025hw":    newBackend("sdvote", SDVOTE_URL, nil),
+		"/lora_previews": newBackend("lora_previews", CADDY_URL, nil),
+	}
+}
+
+// serviceStatus returns the last service update for the maintenance page, nil before the broker is set up
+func serviceStatus() *events.ServiceUpdate {
+	if backendEvents.broker == nil {
+		return nil
+	}
+	if p, ok := backendEvents.broker.State(events.SERVICE_UPDATE).(events.Packet); ok {
+		if su, ok := p.Data.(events.ServiceUpdate); ok {
+			return &su
+		}
+	}
+	return nil
+}
+
+func backendTransport(name string, bc BackendConfig) http.RoundTripper {
+	if t, ok := transports[name]; ok {
+		return t
+	}
+	if bc.ConnectTimeout <= 0 && bc.ResponseHeaderTimeout <= 0 && bc.Retries <= 0 && bc.BreakerThreshold <= 0 {
+		return nil
+	}
+	t := proxy.NewTransport(proxy.TransportOptions{
+		ConnectTimeout:        time.Second * time.Duration(bc.ConnectTimeout),
+		ResponseHeaderTimeout: time.Second * time.Duration(bc.ResponseHeaderTimeout),
+		Retries:               bc.Retries,
+		RetryBackoff:          time.Millisecond * time.Duration(bc.RetryBackoff),
+		BreakerThreshold:      bc.BreakerThreshold,
+		BreakerCooldown:       time.Second * time.Duration(bc.BreakerCooldown),
+		OnStateChange: func(state proxy.BreakerState, failures int) {
+			log.Printf("Circuit breaker for %s is %s after %d failures", name, state, failures)
+			if backendEvents.metrics != nil {
+				backendEvents.metrics <- metrics.MetricUpdate{Type: metrics.CIRCUIT_STATE, Value: float64(state), Labels: []string{name}}
+			}
+			if backendEvents.broker != nil {
+				backendEvents.broker.Broadcast(events.Packet{Type: events.CIRCUIT_UPDATE, Ephemeral: true, Data: events.CircuitUpdate{Backend: name, State: state.String(), Failures: failures}})
+			}
+		},
+	})
+	transports[name] = t
+	return t
+}
+
+// backendInterceptor adds the configured per-backend features to the interceptor
+func backendInterceptor(name string, i *proxy.Interceptor) *proxy.Interceptor {
+	if i == nil {
+		i = &proxy.Interceptor{}
+	}
+	bc := config.Backends[name]
+	retryAfter := bc.RetryAfter
+	if retryAfter <= 0 {
+		retryAfter = 10
+	}
+	i.Maintenance = &proxy.Maintenance{
+		Title:      config.LoginHeader,
+		Name:       name,
+		RetryAfter: time.Second * time.Duration(retryAfter),
+		Status:     serviceStatus,
+	}
+	i.Transport = backendTransport(name, bc)
+	if len(bc.Cache) > 0 {
+		rules := []proxy.CacheRule{}
+		for _, r := range bc.Cache {
+			rules = append(rules, proxy.CacheRule{Path: proxy.MatchPaths(r.Path), TTL: time.Second * time.Duration(r.TTL), Query: r.Query})
+		}
+		dir := ""
+		if config.Cache.Dir != "" {
+			dir = filepath.Join(config.Cache.Dir, name)
+		}
+		i.Cache = proxy.NewCache(rules, dir, config.Cache.MaxEntrySize, config.Cache.MaxMemory, config.Cache.MaxDisk)
+	}
+	return i
+}
+
+func newBackend(name string, targetURL string, i *proxy.Interceptor) echo.MiddlewareFunc {
+	return proxy.NewProxyWrapperStr(targetURL, backendInterceptor(name, i))
+}
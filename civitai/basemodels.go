@@ -0,0 +1,47 @@
+package civitai
+
+import "strings"
+
+const unknownVersion = "unknown"
+
+// BaseModelRule maps the base model names starting with Prefix (case insensitive) to the "sd version" value used by
+// the webui to filter the networks
+type BaseModelRule struct {
+	Prefix  string `yaml:"prefix"`
+	Version string `yaml:"version"`
+}
+
+// DefaultBaseModels covers the CivitAI base model names and the kohya ss_base_model_version values, the SDXL
+// derivatives are reported as SDXL because they're compatible with its checkpoints
+var DefaultBaseModels = []BaseModelRule{
+	{Prefix: "SDXL", Version: "SDXL"},
+	{Prefix: "Pony", Version: "SDXL"},
+	{Prefix: "Illustrious", Version: "SDXL"},
+	{Prefix: "NoobAI", Version: "SDXL"},
+	{Prefix: "SD 1", Version: "SD1"},
+	{Prefix: "sd_v1", Version: "SD1"},
+	{Prefix: "SD 2", Version: "SD2"},
+	{Prefix: "sd_v2", Version: "SD2"},
+	{Prefix: "SD 3", Version: "SD3"},
+	{Prefix: "sd3", Version: "SD3"},
+	{Prefix: "Flux", Version: "Flux"},
+	{Prefix: "Wan", Version: "Wan"},
+	{Prefix: "Hunyuan", Version: "Hunyuan"},
+}
+
+func sdVersion(rules []BaseModelRule, baseModel string) string {
+	if baseModel == "" {
+		return unknownVersion
+	}
+	for _, r := range rules {
+		if len(baseModel) >= len(r.Prefix) && strings.EqualFold(baseModel[:len(r.Prefix)], r.Prefix) {
+			return r.Version
+		}
+	}
+	return unknownVersion
+}
+
+// SDVersion maps the base model name to the "sd version" value, unknown models are reported as "unknown"
+func (d *Downloader) SDVersion(baseModel string) string {
+	return sdVersion(d.BaseModels, baseModel)
+}
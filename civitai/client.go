@@ -0,0 +1,191 @@
+package civitai
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"mime"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefaultBaseURL is the CivitAI site used for the API requests
+const DefaultBaseURL = "https://civitai.com"
+
+// DefaultHosts are the CivitAI site domains accepted in the model links
+var DefaultHosts = []string{"civitai.com", "civitai.red"}
+
+// ClientConfig configures the CivitAI access shared by the uploader and the metadata downloader
+type ClientConfig struct {
+	BaseURL   string   `yaml:"base_url"`   // API site, civitai.com if empty
+	Hosts     []string `yaml:"hosts,flow"` // site domains accepted in the model links, DefaultHosts if empty
+	Token     string   `yaml:"token"`      // API key sent as the Bearer token to the API site
+	UserAgent string   `yaml:"user_agent"`
+	Rate      float64  `yaml:"rate"`    // API requests per second, 0 for no limit
+	Mirror    string   `yaml:"mirror"`  // directory with <sha256>.json model version files checked before the API
+	Offline   bool     `yaml:"offline"` // only use the mirror
+}
+
+// Client sends the rate limited API requests and looks up the models in the mirror
+type Client struct {
+	cfg      ClientConfig
+	c        *http.Client
+	limiter  *limiter
+	rejected sync.Once // logs the rejected API key once
+}
+
+func NewClient(cfg ClientConfig) *Client {
+	cfg.BaseURL = strings.TrimSuffix(cfg.BaseURL, "/")
+	if cfg.BaseURL == "" {
+		cfg.BaseURL = DefaultBaseURL
+	}
+	if len(cfg.Hosts) == 0 {
+		cfg.Hosts = DefaultHosts
+	}
+	result := &Client{cfg: cfg, c: &http.Client{Timeout: time.Second * 30}}
+	if cfg.Rate > 0 {
+		result.limiter = &limiter{interval: time.Duration(float64(time.Second) / cfg.Rate)}
+	}
+	return result
+}
+
+func (c *Client) BaseURL() string {
+	return c.cfg.BaseURL
+}
+
+func (c *Client) HasToken() bool {
+	return c.cfg.Token != ""
+}
+
+// IsSiteHost checks if the model link points to CivitAI
+func (c *Client) IsSiteHost(host string) bool {
+	if u, err := url.Parse(c.cfg.BaseURL); err == nil && u.Host == host {
+		return true
+	}
+	return slices.Contains(c.cfg.Hosts, host)
+}
+
+// Authorize sets the user agent and adds the token to the requests sent to the API site
+func (c *Client) Authorize(req *http.Request) {
+	if c.cfg.UserAgent != "" {
+		req.Header.Set("User-Agent", c.cfg.UserAgent)
+	}
+	if c.cfg.Token != "" && strings.HasPrefix(req.URL.String(), c.cfg.BaseURL+"/") {
+		req.Header.Set("Authorization", "Bearer "+c.cfg.Token)
+	}
+}
+
+// mirrorFile serves the files referenced by the mirror metadata with relative paths
+func (c *Client) mirrorFile(name string) (*http.Response, error) {
+	if c.cfg.Mirror == "" || !filepath.IsLocal(name) {
+		return nil, fmt.Errorf("invalid preview path %s", name)
+	}
+	f, err := os.Open(filepath.Join(c.cfg.Mirror, name))
+	if err != nil {
+		return nil, err
+	}
+	header := http.Header{}
+	header.Set("Content-Type", mime.TypeByExtension(filepath.Ext(name)))
+	return &http.Response{StatusCode: http.StatusOK, Header: header, Body: f}, nil
+}
+
+// Get sends the rate limited request, the paths without scheme are read from the mirror
+func (c *Client) Get(link string) (*http.Response, error) {
+	return c.get(link, true)
+}
+
+// get retries without the API key if it's rejected and fallback is true
+func (c *Client) get(link string, fallback bool) (*http.Response, error) {
+	if !strings.Contains(link, "://") {
+		return c.mirrorFile(link)
+	}
+	if c.cfg.Offline {
+		return nil, fmt.Errorf("offline mode, not fetching %s", link)
+	}
+	c.limiter.wait()
+	req, err := http.NewRequest("GET", link, nil)
+	if err != nil {
+		return nil, err
+	}
+	c.Authorize(req)
+	resp, err := c.c.Do(req)
+	if err != nil || !fallback || req.Header.Get("Authorization") == "" ||
+		(resp.StatusCode != http.StatusUnauthorized && resp.StatusCode != http.StatusForbidden) {
+		return resp, err
+	}
+	// the public models are still available anonymously if the API key is revoked
+	resp.Body.Close()
+	c.rejected.Do(func() { log.Printf("CivitAI rejected the API key, sending anonymous requests") })
+	req.Header.Del("Authorization")
+	return c.c.Do(req)
+}
+
+// API decodes the response of the API method, the path is relative to /api/v1/
+func (c *Client) API(apiPath string, result any) error {
+	return c.api(apiPath, result, true)
+}
+
+func (c *Client) api(apiPath string, result any, fallback bool) error {
+	resp, err := c.get(c.cfg.BaseURL+"/api/v1/"+apiPath, fallback)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return ErrNotFound
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("CivitAI returned code %d", resp.StatusCode)
+	}
+	if err := json.NewDecoder(resp.Body).Decode(result); err != nil {
+		return fmt.Errorf("error decoding CivitAI response: %w", err)
+	}
+	return nil
+}
+
+// CheckToken verifies the API key and returns the user name it belongs to
+func (c *Client) CheckToken() (string, error) {
+	if c.cfg.Token == "" {
+		return "", fmt.Errorf("no API key configured")
+	}
+	var me struct {
+		Username string
+	}
+	if err := c.api("me", &me, false); err != nil {
+		return "", err
+	}
+	if me.Username == "" {
+		return "", fmt.Errorf("the API key is not valid")
+	}
+	return me.Username, nil
+}
+
+// byHash finds the model version in the mirror or using the API
+func (c *Client) byHash(sum string) (*versionInfo, error) {
+	var result versionInfo
+	if c.cfg.Mirror != "" {
+		for _, name := range []string{strings.ToLower(sum), strings.ToUpper(sum)} {
+			data, err := os.ReadFile(filepath.Join(c.cfg.Mirror, name+".json"))
+			if err != nil {
+				continue
+			}
+			if err := json.Unmarshal(data, &result); err != nil {
+				return nil, fmt.Errorf("error parsing mirror file %s.json: %w", name, err)
+			}
+			return &result, nil
+		}
+		if c.cfg.Offline {
+			return nil, ErrNotFound
+		}
+	}
+	if err := c.API("model-versions/by-hash/"+sum, &result); err != nil {
+		return nil, err
+	}
+	return &result, nil
+}
@@ -0,0 +1,59 @@
+package civitai
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestClientToken(t *testing.T) {
+	var auth []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		auth = append(auth, r.Header.Get("Authorization"))
+		if h := r.Header.Get("Authorization"); h != "" && h != "Bearer good" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		w.Write([]byte(`{"username": "apiuser"}`))
+	}))
+	defer srv.Close()
+	tests := []struct {
+		name     string
+		token    string
+		baseURL  string
+		user     string
+		wantAuth []string
+	}{
+		{name: "valid", token: "good", baseURL: srv.URL, user: "apiuser", wantAuth: []string{"Bearer good"}},
+		{name: "rejected falls back to anonymous", token: "bad", baseURL: srv.URL, wantAuth: []string{"Bearer bad", ""}},
+		{name: "not sent to other hosts", token: "good", baseURL: "https://civitai.invalid", wantAuth: []string{""}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			auth = nil
+			c := NewClient(ClientConfig{BaseURL: tt.baseURL, Token: tt.token})
+			resp, err := c.Get(srv.URL + "/api/v1/me")
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp.Body.Close()
+			if len(auth) != len(tt.wantAuth) {
+				t.Fatalf("got requests %q, want %q", auth, tt.wantAuth)
+			}
+			for i := range auth {
+				if auth[i] != tt.wantAuth[i] {
+					t.Errorf("got requests %q, want %q", auth, tt.wantAuth)
+				}
+			}
+			if tt.baseURL != srv.URL {
+				return
+			}
+			user, err := c.CheckToken()
+			if tt.user == "" && err == nil {
+				t.Errorf("got user %s for the rejected token", user)
+			} else if user != tt.user {
+				t.Errorf("got user %q, want %q (%v)", user, tt.user, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,111 @@
+package civitai
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// HashSuffix is the extension of the hash cache file stored next to the model
+const HashSuffix = ".sha256"
+
+var (
+	// ErrHashMismatch means the file content changed while its size and modification time stayed the same
+	ErrHashMismatch = errors.New("hash mismatch, the file is probably corrupted")
+	// ErrNoCachedHash means there was no valid cache entry to verify against, the hash is cached now
+	ErrNoCachedHash = errors.New("no cached hash")
+)
+
+// hashEntry is valid as long as the model size and modification time don't change
+type hashEntry struct {
+	SHA256  string    `json:"sha256"`
+	Size    int64     `json:"size"`
+	ModTime time.Time `json:"mtime"`
+}
+
+func hashFilename(filename string) string {
+	return strings.TrimSuffix(filename, filepath.Ext(filename)) + HashSuffix
+}
+
+// cachedHash returns the cached hash if it matches the current file
+func cachedHash(filename string, fi os.FileInfo) string {
+	data, err := os.ReadFile(hashFilename(filename))
+	if err != nil {
+		return ""
+	}
+	var entry hashEntry
+	if err := json.Unmarshal(data, &entry); err != nil {
+		return ""
+	}
+	if entry.Size != fi.Size() || !entry.ModTime.Equal(fi.ModTime()) {
+		return ""
+	}
+	return entry.SHA256
+}
+
+func storeHash(filename string, fi os.FileInfo, sum string) error {
+	return writeFileAtomic(hashFilename(filename), func(w io.Writer) error {
+		return json.NewEncoder(w).Encode(hashEntry{SHA256: sum, Size: fi.Size(), ModTime: fi.ModTime()})
+	})
+}
+
+// CachedSHA256 returns the model hash from the cache or computes and caches it
+func CachedSHA256(filename string) (string, error) {
+	fi, err := os.Stat(filename)
+	if err != nil {
+		return "", err
+	}
+	if sum := cachedHash(filename, fi); sum != "" {
+		return sum, nil
+	}
+	sum, err := fileSHA256(filename)
+	if err != nil {
+		return "", err
+	}
+	if err := storeHash(filename, fi, sum); err != nil {
+		return "", fmt.Errorf("error caching hash: %w", err)
+	}
+	return sum, nil
+}
+
+// LookupSHA256 returns the cached hash if it's still valid without hashing the file
+func LookupSHA256(filename string, fi os.FileInfo) string {
+	return cachedHash(filename, fi)
+}
+
+// StoreSHA256 caches the hash computed while the file was written
+func StoreSHA256(filename string, sum string) error {
+	fi, err := os.Stat(filename)
+	if err != nil {
+		return err
+	}
+	return storeHash(filename, fi, sum)
+}
+
+// VerifySHA256 rehashes the file and compares the result with the cached hash
+func VerifySHA256(filename string) error {
+	fi, err := os.Stat(filename)
+	if err != nil {
+		return err
+	}
+	cached := cachedHash(filename, fi)
+	sum, err := fileSHA256(filename)
+	if err != nil {
+		return err
+	}
+	if cached == "" {
+		if err := storeHash(filename, fi, sum); err != nil {
+			return fmt.Errorf("error caching hash: %w", err)
+		}
+		return ErrNoCachedHash
+	}
+	if cached != sum {
+		return fmt.Errorf("%w: cached %s, actual %s", ErrHashMismatch, cached, sum)
+	}
+	return nil
+}
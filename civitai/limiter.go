@@ -0,0 +1,28 @@
+package civitai
+
+import (
+	"sync"
+	"time"
+)
+
+// limiter spaces the requests evenly, it's shared by all goroutines using the downloader
+type limiter struct {
+	sync.Mutex
+	interval time.Duration
+	next     time.Time
+}
+
+// wait blocks until the next request is allowed, nil limiter doesn't limit
+func (l *limiter) wait() {
+	if l == nil {
+		return
+	}
+	l.Lock()
+	defer l.Unlock()
+	now := time.Now()
+	if l.next.After(now) {
+		time.Sleep(l.next.Sub(now))
+		now = l.next
+	}
+	l.next = now.Add(l.interval)
+}
@@ -0,0 +1,142 @@
+package civitai
+
+import (
+	"encoding/json"
+	"fmt"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// activationTags is the number of the most frequent training tags suggested as the activation text
+const activationTags = 3
+
+var resolutionRegexp = regexp.MustCompile(`\d+`)
+
+// LocalMetadata is the training information stored in the safetensors header by the kohya scripts
+type LocalMetadata struct {
+	BaseModel    string   // ss_base_model_version as is
+	SDVersion    string   // mapped by the base model rules, unknown if not detected
+	Tags         []string // training tags, the most frequent first
+	Resolution   string
+	NetworkDim   int
+	NetworkAlpha float64
+}
+
+// TagFrequency returns the training tags from ss_tag_frequency sorted by the number of occurrences in all datasets
+func TagFrequency(meta map[string]string) []string {
+	var datasets map[string]map[string]int
+	if err := json.Unmarshal([]byte(meta["ss_tag_frequency"]), &datasets); err != nil {
+		return nil
+	}
+	freq := map[string]int{}
+	for _, tags := range datasets {
+		for tag, count := range tags {
+			if tag = strings.TrimSpace(tag); tag != "" {
+				freq[tag] += count
+			}
+		}
+	}
+	result := make([]string, 0, len(freq))
+	for tag := range freq {
+		result = append(result, tag)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		if freq[result[i]] != freq[result[j]] {
+			return freq[result[i]] > freq[result[j]]
+		}
+		return result[i] < result[j]
+	})
+	return result
+}
+
+// detectSDVersion guesses the model architecture from the metadata or the tensor names if there's no metadata
+func detectSDVersion(h *SafetensorsHeader, rules []BaseModelRule) string {
+	if version := sdVersion(rules, h.Metadata["ss_base_model_version"]); version != unknownVersion {
+		return version
+	}
+	switch h.Metadata["ss_v2"] {
+	case "True":
+		return "SD2"
+	case "False":
+		return "SD1"
+	}
+	for name := range h.Tensors {
+		if strings.HasPrefix(name, "lora_te2_") {
+			return "SDXL"
+		}
+	}
+	return unknownVersion
+}
+
+// networkDim returns the LoRA rank from the metadata or the shape of the first down projection
+func networkDim(h *SafetensorsHeader) int {
+	if dim, err := strconv.Atoi(h.Metadata["ss_network_dim"]); err == nil {
+		return dim
+	}
+	for name, t := range h.Tensors {
+		if strings.HasSuffix(name, ".lora_down.weight") && len(t.Shape) > 0 {
+			return int(t.Shape[0])
+		}
+	}
+	return 0
+}
+
+// ReadLocalMetadata extracts the training information from the header, the base model is mapped using the rules
+func ReadLocalMetadata(h *SafetensorsHeader, rules []BaseModelRule) *LocalMetadata {
+	result := &LocalMetadata{
+		BaseModel:  h.Metadata["ss_base_model_version"],
+		SDVersion:  detectSDVersion(h, rules),
+		Tags:       TagFrequency(h.Metadata),
+		NetworkDim: networkDim(h),
+	}
+	if res := resolutionRegexp.FindAllString(h.Metadata["ss_resolution"], 2); len(res) == 2 {
+		result.Resolution = res[0] + "x" + res[1]
+	}
+	if alpha, err := strconv.ParseFloat(h.Metadata["ss_network_alpha"], 64); err == nil {
+		result.NetworkAlpha = alpha
+	}
+	return result
+}
+
+// ActivationText suggests the most frequent training tags as the trigger words
+func (m *LocalMetadata) ActivationText() string {
+	return strings.Join(m.Tags[:min(len(m.Tags), activationTags)], ", ")
+}
+
+// Notes describes the training parameters for the sidecar file
+func (m *LocalMetadata) Notes() string {
+	var result []string
+	if m.BaseModel != "" {
+		result = append(result, "base model: "+m.BaseModel)
+	}
+	if m.Resolution != "" {
+		result = append(result, "resolution: "+m.Resolution)
+	}
+	if m.NetworkDim > 0 {
+		result = append(result, fmt.Sprintf("dim: %d", m.NetworkDim))
+	}
+	if m.NetworkAlpha > 0 {
+		result = append(result, "alpha: "+strconv.FormatFloat(m.NetworkAlpha, 'g', -1, 64))
+	}
+	return strings.Join(result, ", ")
+}
+
+// localSidecar makes the sidecar from the safetensors header, it returns nil if the file has no useful metadata
+func (d *Downloader) localSidecar(filename string) *sidecar {
+	if !strings.EqualFold(filepath.Ext(filename), ".safetensors") {
+		return nil
+	}
+	header, err := ReadSafetensorsFile(filename)
+	if err != nil {
+		return nil
+	}
+	local := ReadLocalMetadata(header, d.BaseModels)
+	if header.Metadata == nil && local.SDVersion == unknownVersion {
+		return nil
+	}
+	return &sidecar{SDVersion: local.SDVersion, BaseModel: local.BaseModel, ActivationText: local.ActivationText(),
+		Notes: local.Notes()}
+}
@@ -2,27 +2,73 @@ package civitai
 
 import (
 	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"io/fs"
 	"log"
-	"net/http"
 	"os"
 	"path/filepath"
+	"slices"
 	"strings"
-	"time"
 )
 
 type Downloader struct {
-	c               *http.Client
+	Client          *Client
 	PreviewCopyPath string
+	BaseModels      []BaseModelRule
+	Previews        PreviewConfig
 }
 
-func NewDownloader() (result *Downloader) {
-	result = &Downloader{c: &http.Client{}}
-	result.c.Timeout = time.Second * 30
-	return result
+// NewDownloader creates the downloader using the client, anonymous civitai.com client is used if it's nil
+func NewDownloader(client *Client) *Downloader {
+	if client == nil {
+		client = NewClient(ClientConfig{})
+	}
+	return &Downloader{Client: client, BaseModels: DefaultBaseModels}
+}
+
+// ModelExtensions are the model file formats that can be looked up on CivitAI
+var ModelExtensions = []string{".safetensors", ".ckpt", ".pt", ".pth", ".bin"}
+
+// IsModelFile checks if the file has one of the ModelExtensions
+func IsModelFile(filename string) bool {
+	return slices.Contains(ModelExtensions, strings.ToLower(filepath.Ext(filename)))
+}
+
+// sidecar is the model metadata file format used by the webui
+type sidecar struct {
+	Description    string `json:"description"`
+	SDVersion      string `json:"sd version"`
+	ActivationText string `json:"activation text"`
+	Notes          string `json:"notes,omitempty"`
+	BaseModel      string `json:"base model,omitempty"` // the original CivitAI or kohya base model name
+}
+
+func writeSidecar(w io.Writer, metadata any) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "    ")
+	return enc.Encode(metadata)
+}
+
+// mergeSidecar updates the sidecar fields keeping the ones it doesn't model ("preferred weight", "negative text" etc.)
+func mergeSidecar(jsonfilename string, metadata sidecar) error {
+	fields := map[string]any{}
+	if data, err := os.ReadFile(jsonfilename); err == nil {
+		if err := json.Unmarshal(data, &fields); err != nil || fields == nil {
+			fields = map[string]any{}
+		}
+	}
+	data, err := json.Marshal(metadata)
+	if err != nil {
+		return err
+	}
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return err
+	}
+	return writeFileAtomic(jsonfilename, func(w io.Writer) error { return writeSidecar(w, fields) })
 }
 
 func exists(filename string) bool {
@@ -32,7 +78,7 @@ func exists(filename string) bool {
 
 func CopyLink(src string, dst string) error {
 	err := os.Remove(dst)
-	if err != nil {
+	if err != nil && !os.IsNotExist(err) {
 		fmt.Printf("Removing %s failed: %s\n", dst, err)
 	}
 	err = os.Link(src, dst)
@@ -50,121 +96,235 @@ func CopyLink(src string, dst string) error {
 		return err
 	}
 	defer tf.Close()
+	if err := tf.Chmod(fileMode); err != nil {
+		return err
+	}
 	_, err = io.Copy(tf, sf)
 	return err
 }
 
+// versionInfo is the CivitAI model version returned by the hash lookup
+type versionInfo struct {
+	Description  string
+	TrainedWords []string
+	BaseModel    string // "SD 1.5", "SDXL 1.0", "Pony", "Flux.1 D" etc.
+	Images       []versionImage
+	Error        string
+}
+
+// ErrNotFound is returned if the model hash is unknown to CivitAI
+var ErrNotFound = errors.New("not found on CivitAI")
+
+// ErrUpToDate is returned by Update and Refresh if the model doesn't need to be updated
+var ErrUpToDate = errors.New("already up to date")
+
+func fileSHA256(filename string) (string, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// lookup finds the model version by the file hash
+func (d *Downloader) lookup(filename string) (*versionInfo, error) {
+	sum, err := CachedSHA256(filename)
+	if err != nil {
+		return nil, err
+	}
+	return d.Client.byHash(sum)
+}
+
+// UpdateOptions control which models are updated and how
+type UpdateOptions struct {
+	Force     bool   // fetch the metadata even if the sidecar or preview exists
+	StubsOnly bool   // only update the models with a missing or empty sidecar or without a preview
+	Preview   string // preferred preview type, "image" or "video", the first one is used if empty
+}
+
+// isStub checks if the sidecar is missing or was written for a model not found on CivitAI
+func isStub(jsonfilename string) bool {
+	data, err := os.ReadFile(jsonfilename)
+	if err != nil {
+		return true
+	}
+	var fields map[string]any
+	return json.Unmarshal(data, &fields) != nil || len(fields) == 0
+}
+
+// fileMode lets the UI and the other tools running as different users replace the metadata and previews, it's set
+// explicitly because changing the process-wide umask races with the concurrent updates
+const fileMode = 0666
+
+// writeFileAtomic writes the file so that it's never left partially written
+func writeFileAtomic(filename string, write func(w io.Writer) error) error {
+	f, err := os.CreateTemp(filepath.Dir(filename), "."+filepath.Base(filename)+".tmp-*")
+	if err != nil {
+		return err
+	}
+	tmp := f.Name()
+	err = f.Chmod(fileMode)
+	if err == nil {
+		err = write(f)
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	if err := os.Rename(tmp, filename); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return nil
+}
+
 func (d *Downloader) UpdateFile(filename string) error {
-	oldumask := maybeUmask(0111)
-	defer maybeUmask(oldumask)
+	if err := d.Update(filename, UpdateOptions{}); err != ErrUpToDate {
+		return err
+	}
+	return nil
+}
+
+// Update fetches the metadata and the preview of the model, ErrUpToDate is returned if the model is skipped
+func (d *Downloader) Update(filename string, opts UpdateOptions) error {
 	ext := filepath.Ext(filename)
-	if ext != ".safetensors" {
+	if !IsModelFile(filename) {
 		return fmt.Errorf("invalid extension")
 	}
 	filebase := filename[:len(filename)-len(ext)]
 	preview_img := filebase + ".preview.png"
 	preview_vid := filebase + ".preview.mp4"
 	jsonfilename := filebase + ".json"
-	if exists(preview_img) || exists(preview_vid) || exists(jsonfilename) {
-		return nil
+	hasPreview := exists(preview_img) || exists(preview_vid)
+	switch {
+	case opts.Force:
+	case opts.StubsOnly:
+		if hasPreview && !isStub(jsonfilename) {
+			return ErrUpToDate
+		}
+	case hasPreview || exists(jsonfilename):
+		return ErrUpToDate
+	}
+
+	civitaiMetadata, err := d.lookup(filename)
+	if err == ErrNotFound {
+		if metadata := d.localSidecar(filename); metadata != nil && isStub(jsonfilename) {
+			return mergeSidecar(jsonfilename, *metadata)
+		}
+		if !exists(jsonfilename) {
+			writeFileAtomic(jsonfilename, func(w io.Writer) error {
+				_, err := io.WriteString(w, "{}")
+				return err
+			})
+		}
+		return fmt.Errorf("model %s %w", filepath.Base(filename), ErrNotFound)
 	}
-	modelfile, err := os.Open(filename)
 	if err != nil {
 		return err
 	}
-	defer modelfile.Close()
-	jsonfile, err := os.Create(jsonfilename)
-	if err != nil {
+	metadata := sidecar{
+		Description:    civitaiMetadata.Description,
+		SDVersion:      d.SDVersion(civitaiMetadata.BaseModel),
+		BaseModel:      civitaiMetadata.BaseModel,
+		ActivationText: strings.Join(civitaiMetadata.TrainedWords, "; "),
+	}
+	if err := mergeSidecar(jsonfilename, metadata); err != nil {
 		return err
 	}
-	defer jsonfile.Close()
 
-	h := sha256.New()
-	_, err = io.Copy(h, modelfile)
-	if err != nil {
-		return err
+	images := civitaiMetadata.previews(opts.Preview, d.Previews.MaxNSFWLevel)
+	if len(images) == 0 || (hasPreview && !opts.Force) {
+		return nil
 	}
-	sum := h.Sum(nil)
-	resp, err := d.c.Get(fmt.Sprintf("https://civitai.com/api/v1/model-versions/by-hash/%x", sum))
-	if err != nil {
-		return err
+	return d.savePreviews(filebase, images)
+}
+
+// Refresh rewrites the sd version of the existing sidecar if it was unknown, the base model stored in the sidecar is
+// remapped without querying CivitAI, the other fields are kept unless they're empty
+func (d *Downloader) Refresh(filename string) error {
+	if !IsModelFile(filename) {
+		return fmt.Errorf("invalid extension")
+	}
+	jsonfilename := strings.TrimSuffix(filename, filepath.Ext(filename)) + ".json"
+	data, err := os.ReadFile(jsonfilename)
+	if os.IsNotExist(err) {
+		return d.UpdateFile(filename)
 	}
-	if resp.StatusCode == 404 {
-		jsonfile.WriteString("{}")
-		return fmt.Errorf("model %s not found on CivitAI", filepath.Base(filename))
-	}
-	var civitaiMetadata struct {
-		Description  string
-		TrainedWords []string
-		BaseModel    string // "SD 1.5", "SDXL 1.0"
-		Images       []struct {
-			URL  string
-			Type string
-		}
-		Error string
-	}
-	var metadata struct {
-		Description    string `json:"description"`
-		SDVersion      string `json:"sd version"`
-		ActivationText string `json:"activation text"`
-	}
-	json.NewDecoder(resp.Body).Decode(&civitaiMetadata)
-	metadata.Description = civitaiMetadata.Description
-	if strings.HasPrefix(civitaiMetadata.BaseModel, "SDXL") {
-		metadata.SDVersion = "SDXL"
-	} else if strings.HasPrefix(civitaiMetadata.BaseModel, "SD 1") {
-		metadata.SDVersion = "SD1"
-	} else if strings.HasPrefix(civitaiMetadata.BaseModel, "SD 2") {
-		metadata.SDVersion = "SD2"
-	} else {
-		metadata.SDVersion = "unknown"
-	}
-	metadata.ActivationText = strings.Join(civitaiMetadata.TrainedWords, "; ")
-
-	enc := json.NewEncoder(jsonfile)
-	enc.SetIndent("", "    ")
-	err = enc.Encode(metadata)
 	if err != nil {
 		return err
 	}
-
-	for _, img := range civitaiMetadata.Images {
-		if img.Type == "image" || img.Type == "video" {
-			resp, err = d.c.Get(img.URL)
-			if err != nil {
-				return err
+	var metadata sidecar
+	if err := json.Unmarshal(data, &metadata); err != nil {
+		return fmt.Errorf("error parsing %s: %w", jsonfilename, err)
+	}
+	if metadata.SDVersion != "" && metadata.SDVersion != unknownVersion {
+		return ErrUpToDate
+	}
+	version := d.SDVersion(metadata.BaseModel)
+	changed := false
+	if metadata.BaseModel == "" {
+		info, err := d.lookup(filename)
+		switch {
+		case err == ErrNotFound:
+			local := d.localSidecar(filename)
+			if local == nil {
+				return fmt.Errorf("model %s %w", filepath.Base(filename), ErrNotFound)
 			}
-			preview_name := preview_img
-			if img.Type == "video" {
-				preview_name = preview_vid
+			version = local.SDVersion
+			metadata.BaseModel = local.BaseModel
+			if metadata.ActivationText == "" {
+				metadata.ActivationText = local.ActivationText
 			}
-			previewfile, err := os.Create(preview_name)
-			if err != nil {
-				return err
+			if metadata.Notes == "" {
+				metadata.Notes = local.Notes
 			}
-			_, err = io.Copy(previewfile, resp.Body)
-			if err != nil {
-				previewfile.Close()
-				return err
+		case err != nil:
+			return err
+		default:
+			version = d.SDVersion(info.BaseModel)
+			metadata.BaseModel = info.BaseModel
+			if metadata.Description == "" {
+				metadata.Description = info.Description
+			}
+			if metadata.ActivationText == "" {
+				metadata.ActivationText = strings.Join(info.TrainedWords, "; ")
 			}
-			previewfile.Close()
-			break
 		}
+		changed = metadata.BaseModel != ""
 	}
-	return nil
+	if version == metadata.SDVersion && !changed {
+		return ErrUpToDate
+	}
+	metadata.SDVersion = version
+	return mergeSidecar(jsonfilename, metadata)
 }
 
 func (d *Downloader) Walk(root string, result func(path string, err error)) error {
+	return walkModels(root, d.UpdateFile, result)
+}
+
+func walkModels(root string, update func(filename string) error, result func(path string, err error)) error {
 	return filepath.WalkDir(root, func(path string, dir fs.DirEntry, err error) error {
 		if err != nil {
 			log.Printf("Error accessing %s: %s", path, err)
 			return nil
 		}
 		if dir.IsDir() {
+			if strings.HasPrefix(dir.Name(), ".") && path != root {
+				return filepath.SkipDir // trash, unfinished uploads etc.
+			}
 			return nil
 		}
-		if filepath.Ext(path) == ".safetensors" {
-			err := d.UpdateFile(path)
+		if IsModelFile(path) {
+			err := update(path)
 			if result != nil {
 				result(path, err)
 			}
@@ -0,0 +1,221 @@
+package civitai
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/draw"
+	_ "image/gif"
+	_ "image/jpeg"
+	"image/png"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	xdraw "golang.org/x/image/draw"
+	_ "golang.org/x/image/webp"
+)
+
+// maxImageSize limits the image previews loaded into memory for conversion
+const maxImageSize = 64 * 1024 * 1024
+
+const (
+	// ThumbnailSuffix is the small PNG preview saved next to the model
+	ThumbnailSuffix = ".thumb.png"
+	// GallerySuffix is the directory with the extra preview images
+	GallerySuffix = ".previews"
+)
+
+// PreviewConfig controls which CivitAI images are saved as the model previews
+type PreviewConfig struct {
+	MaxNSFWLevel int  `yaml:"max_nsfw_level"` // CivitAI nsfwLevel (1 PG, 2 PG-13, 4 R, 8 X, 16 XXX), 0 allows all, the unrated images are skipped if limited
+	ConvertPNG   bool `yaml:"convert_png"`    // re-encode the image preview as PNG since CivitAI mostly serves JPEG/WebP
+	Thumbnail    int  `yaml:"thumbnail"`      // longest side of the thumbnail, 0 disables it
+	Gallery      int  `yaml:"gallery"`        // number of extra images saved to the gallery directory
+}
+
+type versionImage struct {
+	URL       string
+	Type      string
+	NSFWLevel int `json:"nsfwLevel"`
+}
+
+// previews returns the suitable images, the first one is the main preview, if the NSFW level is limited the safest
+// images come first and the unrated ones (level 0) are skipped
+func (v *versionInfo) previews(preferred string, maxLevel int) []versionImage {
+	var result []versionImage
+	for _, img := range v.Images {
+		if (img.Type == "image" || img.Type == "video") && (maxLevel <= 0 || (img.NSFWLevel > 0 && img.NSFWLevel <= maxLevel)) {
+			result = append(result, img)
+		}
+	}
+	sort.SliceStable(result, func(i, j int) bool {
+		if pi, pj := result[i].Type == preferred, result[j].Type == preferred; pi != pj {
+			return pi
+		}
+		return maxLevel > 0 && result[i].NSFWLevel < result[j].NSFWLevel
+	})
+	return result
+}
+
+func (d *Downloader) fetch(url string) (*http.Response, error) {
+	resp, err := d.Client.Get(url)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, fmt.Errorf("error downloading preview: server returned code %d", resp.StatusCode)
+	}
+	return resp, nil
+}
+
+// scaleImage fits the image into size x size keeping the aspect ratio
+func scaleImage(img image.Image, size int) image.Image {
+	bounds := img.Bounds()
+	w, h := bounds.Dx(), bounds.Dy()
+	if max(w, h) <= size {
+		return img
+	}
+	scale := float64(size) / float64(max(w, h))
+	dst := image.NewRGBA(image.Rect(0, 0, max(1, int(float64(w)*scale)), max(1, int(float64(h)*scale))))
+	xdraw.CatmullRom.Scale(dst, dst.Bounds(), img, bounds, draw.Src, nil)
+	return dst
+}
+
+func writePNG(filename string, img image.Image) error {
+	return writeFileAtomic(filename, func(w io.Writer) error { return png.Encode(w, img) })
+}
+
+// saveImagePreview writes the image preview, converting it and making the thumbnail if configured, the original
+// data is kept if the image can't be decoded
+func (d *Downloader) saveImagePreview(filebase string, url string) error {
+	resp, err := d.fetch(url)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(io.LimitReader(resp.Body, maxImageSize+1))
+	if err != nil {
+		return err
+	}
+	if len(data) > maxImageSize {
+		return fmt.Errorf("preview %s is larger than %d bytes", url, maxImageSize)
+	}
+	var img image.Image
+	if d.Previews.ConvertPNG || d.Previews.Thumbnail > 0 {
+		if img, _, err = image.Decode(bytes.NewReader(data)); err != nil {
+			log.Printf("Error decoding preview %s: %s", url, err)
+		}
+	}
+	preview := filebase + ".preview.png"
+	if img != nil && d.Previews.ConvertPNG && http.DetectContentType(data) != "image/png" {
+		err = writePNG(preview, img)
+	} else {
+		err = writeFileAtomic(preview, func(w io.Writer) error {
+			_, err := w.Write(data)
+			return err
+		})
+	}
+	if err != nil {
+		return err
+	}
+	if img != nil && d.Previews.Thumbnail > 0 {
+		return writePNG(filebase+ThumbnailSuffix, scaleImage(img, d.Previews.Thumbnail))
+	}
+	return nil
+}
+
+func (d *Downloader) saveVideoPreview(filename string, url string) error {
+	resp, err := d.fetch(url)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	return writeFileAtomic(filename, func(w io.Writer) error {
+		_, err := io.Copy(w, resp.Body)
+		return err
+	})
+}
+
+// mediaExt returns the file extension for the gallery item
+func mediaExt(contentType string, url string, typ string) string {
+	switch strings.Split(contentType, ";")[0] {
+	case "image/jpeg":
+		return ".jpg"
+	case "image/png":
+		return ".png"
+	case "image/webp":
+		return ".webp"
+	case "image/gif":
+		return ".gif"
+	case "video/mp4":
+		return ".mp4"
+	case "video/webm":
+		return ".webm"
+	}
+	if ext := path.Ext(url); ext != "" && len(ext) <= 5 {
+		return strings.ToLower(ext)
+	}
+	if typ == "video" {
+		return ".mp4"
+	}
+	return ".jpg"
+}
+
+// saveGallery replaces the gallery directory contents with the images
+func (d *Downloader) saveGallery(dir string, images []versionImage) error {
+	if err := os.RemoveAll(dir); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	for i, img := range images {
+		resp, err := d.fetch(img.URL)
+		if err != nil {
+			return err
+		}
+		filename := filepath.Join(dir, fmt.Sprintf("%02d%s", i+1, mediaExt(resp.Header.Get("Content-Type"), img.URL, img.Type)))
+		err = writeFileAtomic(filename, func(w io.Writer) error {
+			_, err := io.Copy(w, resp.Body)
+			return err
+		})
+		resp.Body.Close()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// savePreviews writes the main preview and the gallery
+func (d *Downloader) savePreviews(filebase string, images []versionImage) error {
+	preview_img := filebase + ".preview.png"
+	preview_vid := filebase + ".preview.mp4"
+	var err error
+	if images[0].Type == "video" {
+		err = d.saveVideoPreview(preview_vid, images[0].URL)
+		os.Remove(filebase + ThumbnailSuffix)
+	} else {
+		err = d.saveImagePreview(filebase, images[0].URL)
+	}
+	if err != nil {
+		return err
+	}
+	// the webui shows the image first, keep only the new preview
+	if images[0].Type == "video" {
+		os.Remove(preview_img)
+	} else {
+		os.Remove(preview_vid)
+	}
+	if d.Previews.Gallery > 0 && len(images) > 1 {
+		return d.saveGallery(filebase+GallerySuffix, images[1:min(len(images), d.Previews.Gallery+1)])
+	}
+	return nil
+}
@@ -0,0 +1,83 @@
+package civitai
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+)
+
+// maxHeaderSize is the header size limit used by the reference safetensors implementation
+const maxHeaderSize = 100 * 1024 * 1024
+
+type Tensor struct {
+	DType       string   `json:"dtype"`
+	Shape       []int64  `json:"shape"`
+	DataOffsets [2]int64 `json:"data_offsets"`
+}
+
+// SafetensorsHeader is the parsed JSON header of a safetensors file
+type SafetensorsHeader struct {
+	Metadata map[string]string
+	Tensors  map[string]Tensor
+}
+
+// ReadSafetensorsHeader parses and validates the header, size is the total file size used to check the tensor offsets
+func ReadSafetensorsHeader(r io.Reader, size int64) (*SafetensorsHeader, error) {
+	var headerSize uint64
+	if err := binary.Read(r, binary.LittleEndian, &headerSize); err != nil {
+		return nil, fmt.Errorf("error reading safetensors header size: %w", err)
+	}
+	if headerSize < 2 || headerSize > maxHeaderSize || int64(headerSize) > size-8 {
+		return nil, fmt.Errorf("invalid safetensors header size %d", headerSize)
+	}
+	buf := make([]byte, headerSize)
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return nil, fmt.Errorf("error reading safetensors header: %w", err)
+	}
+	if buf[0] != '{' {
+		return nil, fmt.Errorf("safetensors header is not a JSON object")
+	}
+	var raw map[string]json.RawMessage
+	if err := json.Unmarshal(bytes.TrimRight(buf, " "), &raw); err != nil {
+		return nil, fmt.Errorf("error parsing safetensors header: %w", err)
+	}
+	result := &SafetensorsHeader{Tensors: map[string]Tensor{}}
+	dataSize := size - 8 - int64(headerSize)
+	for name, v := range raw {
+		if name == "__metadata__" {
+			if err := json.Unmarshal(v, &result.Metadata); err != nil {
+				return nil, fmt.Errorf("invalid safetensors metadata: %w", err)
+			}
+			continue
+		}
+		var t Tensor
+		if err := json.Unmarshal(v, &t); err != nil {
+			return nil, fmt.Errorf("invalid tensor %s: %w", name, err)
+		}
+		if t.DType == "" || t.DataOffsets[0] < 0 || t.DataOffsets[0] > t.DataOffsets[1] || t.DataOffsets[1] > dataSize {
+			return nil, fmt.Errorf("invalid tensor %s", name)
+		}
+		result.Tensors[name] = t
+	}
+	if len(result.Tensors) == 0 {
+		return nil, fmt.Errorf("no tensors found")
+	}
+	return result, nil
+}
+
+// ReadSafetensorsFile reads the header of the file
+func ReadSafetensorsFile(filename string) (*SafetensorsHeader, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	return ReadSafetensorsHeader(f, fi.Size())
+}
@@ -1,7 +0,0 @@
-package civitai
-
-import "syscall"
-
-func maybeUmask(mask int) (oldmask int) {
-	return syscall.Umask(mask)
-}
@@ -1,5 +0,0 @@
-package civitai
-
-func maybeUmask(mask int) (oldmask int) {
-	return 0
-}
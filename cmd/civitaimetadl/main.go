@@ -1,28 +1,175 @@
 package main
 
 import (
+	"encoding/json"
+	"errors"
+	"io/fs"
 	"log"
 	"os"
 	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
 
+	"github.com/btcsuite/go-flags"
 	"github.com/rkfg/authproxy/civitai"
+	"gopkg.in/yaml.v3"
 )
 
-func main() {
-	if len(os.Args) != 2 {
-		log.Fatal("Provide the model path as the only argument")
+var params struct {
+	Refresh bool    `long:"refresh" description:"Update the sd version in the existing sidecars where it's unknown"`
+	Verify  bool    `long:"verify" description:"Rehash the models and report the ones that changed without a modification time change"`
+	Force   bool    `short:"f" long:"force" description:"Fetch the metadata and preview even if they exist"`
+	Stubs   bool    `long:"stubs" description:"Only retry the models with empty sidecars or missing previews"`
+	Preview string  `long:"preview" description:"Preferred preview type (image or video)"`
+	MaxNSFW int     `long:"max-nsfw" description:"Skip the unrated preview images and the ones above this CivitAI nsfwLevel (1, 2, 4, 8, 16)"`
+	PNG     bool    `long:"png" description:"Convert the image previews to PNG"`
+	Thumb   int     `long:"thumbnail" description:"Save thumbnails with this longest side"`
+	Gallery int     `long:"gallery" description:"Number of extra preview images to save in the gallery directory"`
+	Jobs    int     `short:"j" long:"jobs" description:"Number of parallel workers" default:"1"`
+	Token   string  `long:"token" env:"CIVITAI_TOKEN" description:"CivitAI API key"`
+	Rate    float64 `long:"rate" description:"Maximum CivitAI requests per second, 0 for no limit"`
+	BaseURL string  `long:"base-url" description:"CivitAI API site" default:"https://civitai.com"`
+	Agent   string  `long:"user-agent" description:"User agent for the CivitAI requests"`
+	Mirror  string  `long:"mirror" description:"Directory with <sha256>.json model version files checked before CivitAI"`
+	Offline bool    `long:"offline" description:"Only use the mirror directory, don't access CivitAI"`
+	Report  string  `long:"report" description:"Write the JSON summary to this file, - for stdout"`
+	Mapping string  `short:"m" long:"mapping" description:"YAML file with the base model mapping (list of prefix and version)"`
+	Args    struct {
+		Path string `positional-arg-name:"path" description:"Model file or directory"`
+	} `positional-args:"yes" required:"yes"`
+}
+
+type report struct {
+	sync.Mutex `json:"-"`
+	Updated    []string          `json:"updated"`
+	NotFound   []string          `json:"not_found"`
+	Corrupted  []string          `json:"corrupted"`
+	Skipped    int               `json:"skipped"`
+	Hashed     int               `json:"hashed"` // no cached hash to verify against
+	Errors     map[string]string `json:"errors"`
+	success    string            // logged for the updated or verified files
+}
+
+func (r *report) add(path string, err error) {
+	r.Lock()
+	defer r.Unlock()
+	basename := filepath.Base(path)
+	switch {
+	case errors.Is(err, civitai.ErrUpToDate):
+		r.Skipped++
+	case errors.Is(err, civitai.ErrNoCachedHash):
+		r.Hashed++
+	case errors.Is(err, civitai.ErrHashMismatch):
+		r.Corrupted = append(r.Corrupted, path)
+		log.Printf("File %s is corrupted: %s", basename, err)
+	case errors.Is(err, civitai.ErrNotFound):
+		r.NotFound = append(r.NotFound, path)
+		log.Printf("Model %s not found on CivitAI", basename)
+	case err != nil:
+		r.Errors[path] = err.Error()
+		log.Printf("Error updating %s: %s", basename, err)
+	default:
+		r.Updated = append(r.Updated, path)
+		log.Printf("File %s %s.", basename, r.success)
 	}
-	dl := civitai.NewDownloader()
-	filename := os.Args[1]
-	err := dl.Walk(filename, func(path string, err error) {
-		basename := filepath.Base(path)
+}
+
+func (r *report) save(filename string) error {
+	sort.Strings(r.Updated)
+	sort.Strings(r.NotFound)
+	sort.Strings(r.Corrupted)
+	data, err := json.MarshalIndent(r, "", "    ")
+	if err != nil {
+		return err
+	}
+	if filename == "-" {
+		_, err = os.Stdout.Write(append(data, '\n'))
+		return err
+	}
+	return os.WriteFile(filename, data, 0644)
+}
+
+func modelFiles(root string) ([]string, error) {
+	var result []string
+	err := filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
 		if err != nil {
-			log.Printf("Error updating %s: %s", basename, err)
-		} else {
-			log.Printf("File %s updated successfully.", basename)
+			log.Printf("Error accessing %s: %s", path, err)
+			return nil
 		}
+		if d.IsDir() && strings.HasPrefix(d.Name(), ".") && path != root {
+			return filepath.SkipDir // trash, unfinished uploads etc.
+		}
+		if !d.IsDir() && civitai.IsModelFile(path) {
+			result = append(result, path)
+		}
+		return nil
 	})
+	return result, err
+}
+
+func main() {
+	if _, err := flags.Parse(&params); err != nil {
+		os.Exit(1)
+	}
+	if params.Preview != "" && params.Preview != "image" && params.Preview != "video" {
+		log.Fatalf("Invalid preview type %s", params.Preview)
+	}
+	if params.Offline && params.Mirror == "" {
+		log.Fatal("--offline requires --mirror")
+	}
+	dl := civitai.NewDownloader(civitai.NewClient(civitai.ClientConfig{BaseURL: params.BaseURL, Token: params.Token,
+		UserAgent: params.Agent, Rate: params.Rate, Mirror: params.Mirror, Offline: params.Offline}))
+	dl.Previews = civitai.PreviewConfig{MaxNSFWLevel: params.MaxNSFW, ConvertPNG: params.PNG, Thumbnail: params.Thumb,
+		Gallery: params.Gallery}
+	if params.Mapping != "" {
+		data, err := os.ReadFile(params.Mapping)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if err := yaml.Unmarshal(data, &dl.BaseModels); err != nil {
+			log.Fatalf("Error parsing %s: %s", params.Mapping, err)
+		}
+	}
+	files, err := modelFiles(params.Args.Path)
 	if err != nil {
 		log.Fatal(err)
 	}
+	r := report{Updated: []string{}, NotFound: []string{}, Corrupted: []string{}, Errors: map[string]string{},
+		success: "updated successfully"}
+	opts := civitai.UpdateOptions{Force: params.Force, StubsOnly: params.Stubs, Preview: params.Preview}
+	update := func(path string) error { return dl.Update(path, opts) }
+	switch {
+	case params.Verify:
+		update = civitai.VerifySHA256
+		r.success = "verified"
+	case params.Refresh:
+		update = dl.Refresh
+	}
+	queue := make(chan string)
+	var wg sync.WaitGroup
+	for range max(params.Jobs, 1) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for path := range queue {
+				r.add(path, update(path))
+			}
+		}()
+	}
+	for _, f := range files {
+		queue <- f
+	}
+	close(queue)
+	wg.Wait()
+	if params.Verify {
+		log.Printf("Verified: %d, corrupted: %d, hashed: %d, errors: %d", len(r.Updated), len(r.Corrupted), r.Hashed, len(r.Errors))
+	} else {
+		log.Printf("Updated: %d, not found: %d, skipped: %d, errors: %d", len(r.Updated), len(r.NotFound), r.Skipped, len(r.Errors))
+	}
+	if params.Report != "" {
+		if err := r.save(params.Report); err != nil {
+			log.Fatal(err)
+		}
+	}
 }
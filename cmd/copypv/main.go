@@ -3,22 +3,60 @@ package main
 import (
 	"fmt"
 	"io/fs"
+	"log"
 	"os"
 	"path/filepath"
 	"strings"
+	"time"
 
+	"github.com/btcsuite/go-flags"
 	"github.com/rkfg/authproxy/civitai"
 )
 
-func main() {
-	if len(os.Args) != 3 {
-		fmt.Println("Provide source and destination directories to copy the previews")
-		os.Exit(1)
+var params struct {
+	Patterns []string      `short:"p" long:"pattern" description:"File name pattern to copy, can be repeated (default: *.preview.png, *.preview.mp4)"`
+	Prune    bool          `long:"prune" description:"Remove the matching files in the destination that don't exist in the source"`
+	DryRun   bool          `short:"n" long:"dry-run" description:"Only report what would be done"`
+	Watch    bool          `short:"w" long:"watch" description:"Keep running and sync periodically"`
+	Interval time.Duration `long:"interval" description:"Sync interval for --watch" default:"1m"`
+	Args     struct {
+		Src string `positional-arg-name:"src" description:"Source directory"`
+		Dst string `positional-arg-name:"dst" description:"Destination directory"`
+	} `positional-args:"yes" required:"yes"`
+}
+
+type stats struct {
+	copied    int
+	unchanged int
+	removed   int
+	errors    int
+}
+
+func matches(name string) bool {
+	for _, p := range params.Patterns {
+		if ok, _ := filepath.Match(p, name); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// hidden checks if the directory is the uploader trash, staging or another hidden directory that is skipped
+func hidden(path string, root string, d fs.DirEntry) bool {
+	return d.IsDir() && path != root && strings.HasPrefix(d.Name(), ".")
+}
+
+// unchanged checks if the target is the same file (hard link) or a copy with the same size and modification time
+func unchanged(src fs.FileInfo, dst string) bool {
+	fi, err := os.Stat(dst)
+	if err != nil {
+		return false
 	}
-	src := os.Args[1]
-	dst := os.Args[2]
-	_ = dst
-	err := filepath.WalkDir(src, func(path string, d fs.DirEntry, err error) error {
+	return os.SameFile(src, fi) || (fi.Size() == src.Size() && fi.ModTime().Equal(src.ModTime()))
+}
+
+func copyFiles(src string, dst string, s *stats) error {
+	return filepath.WalkDir(src, func(path string, d fs.DirEntry, err error) error {
 		if err != nil {
 			return err
 		}
@@ -28,17 +66,115 @@ func main() {
 		}
 		targetName := filepath.Join(dst, rel)
 		if d.IsDir() {
-			err = os.MkdirAll(targetName, 0755)
+			if hidden(path, src, d) {
+				return filepath.SkipDir
+			}
+			if params.DryRun {
+				return nil
+			}
+			return os.MkdirAll(targetName, 0755)
+		}
+		if !matches(d.Name()) {
+			return nil
+		}
+		fi, err := d.Info()
+		if err != nil {
+			return err
+		}
+		if unchanged(fi, targetName) {
+			s.unchanged++
+			return nil
+		}
+		fmt.Printf("Linking/copying %s to %s\n", path, targetName)
+		s.copied++
+		if params.DryRun {
+			return nil
+		}
+		if err := civitai.CopyLink(path, targetName); err != nil {
+			fmt.Printf("Error copying %s: %s\n", path, err)
+			s.errors++
+			return nil
+		}
+		// copies get the source time so that they're skipped next time
+		return os.Chtimes(targetName, time.Now(), fi.ModTime())
+	})
+}
+
+// prune removes the matching files that have no source counterpart
+func prune(src string, dst string, s *stats) error {
+	return filepath.WalkDir(dst, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
 			return err
 		}
-		if strings.HasSuffix(d.Name(), ".preview.png") || strings.HasSuffix(d.Name(), ".preview.mp4") {
-			fmt.Printf("Linking/copying %s to %s\n", path, targetName)
-			return civitai.CopyLink(path, targetName)
+		if hidden(path, dst, d) {
+			return filepath.SkipDir
+		}
+		if d.IsDir() || !matches(d.Name()) {
+			return nil
+		}
+		rel, err := filepath.Rel(dst, path)
+		if err != nil {
+			return err
+		}
+		if _, err := os.Lstat(filepath.Join(src, rel)); !os.IsNotExist(err) {
+			return nil
+		}
+		fmt.Printf("Removing %s\n", path)
+		s.removed++
+		if params.DryRun {
+			return nil
+		}
+		if err := os.Remove(path); err != nil {
+			fmt.Printf("Error removing %s: %s\n", path, err)
+			s.errors++
 		}
 		return nil
 	})
-	if err != nil {
-		fmt.Print(err)
+}
+
+func sync(src string, dst string) error {
+	var s stats
+	if err := copyFiles(src, dst, &s); err != nil {
+		return err
+	}
+	if params.Prune {
+		if err := prune(src, dst, &s); err != nil {
+			return err
+		}
+	}
+	if s.copied > 0 || s.removed > 0 || s.errors > 0 || !params.Watch {
+		prefix := ""
+		if params.DryRun {
+			prefix = "Dry run: "
+		}
+		fmt.Printf("%scopied %d, unchanged %d, removed %d, errors %d\n", prefix, s.copied, s.unchanged, s.removed, s.errors)
+	}
+	return nil
+}
+
+func main() {
+	if _, err := flags.Parse(&params); err != nil {
 		os.Exit(1)
 	}
+	if len(params.Patterns) == 0 {
+		params.Patterns = []string{"*.preview.png", "*.preview.mp4"}
+	}
+	for _, p := range params.Patterns {
+		if _, err := filepath.Match(p, ""); err != nil {
+			log.Fatalf("Invalid pattern %s: %s", p, err)
+		}
+	}
+	for {
+		if err := sync(params.Args.Src, params.Args.Dst); err != nil {
+			if !params.Watch {
+				fmt.Print(err)
+				os.Exit(1)
+			}
+			log.Printf("Sync error: %s", err)
+		}
+		if !params.Watch {
+			return
+		}
+		time.Sleep(params.Interval)
+	}
 }
@@ -12,7 +12,7 @@ import (
 )
 
 func newCUIProxy(cuiurl *url.URL) echo.MiddlewareFunc {
-	return proxy.NewProxyWrapper(cuiurl, nil)
+	return proxy.NewProxyWrapper(cuiurl, backendInterceptor("cui", nil))
 }
 
 func addCUIHandlers(e *echo.Echo, sq *servicequeue.ServiceQueue, cuiurl *url.URL) {
@@ -3,25 +3,55 @@ package main
 import (
 	"os"
 
+	"github.com/rkfg/authproxy/civitai"
+	"github.com/rkfg/authproxy/upload"
 	"gopkg.in/yaml.v3"
 )
 
 type ACL map[string][]string
 
+type VisionConfig struct {
+	MaxDimension int      `yaml:"max_dimension" description:"Downscale images in LLM requests so that the longest side fits, 0 to disable"`
+	FetchTimeout int      `yaml:"fetch_timeout" description:"Timeout in seconds for fetching remote image URLs"`
+	MaxFetchSize int64    `yaml:"max_fetch_size" description:"Maximum size of a remote or inline image in bytes"`
+	MaxPixels    int      `yaml:"max_pixels" description:"Maximum width×height of the images decoded for conversion, 0 for no limit"`
+	Decoder      []string `yaml:"decoder,flow" description:"Command converting AVIF/HEIC from stdin to PNG on stdout"`
+}
+
+type LLMPolicy struct {
+	Defaults      map[string]any `yaml:"defaults" description:"Fields set in completion requests if the client didn't specify them"`
+	Inject        map[string]any `yaml:"inject" description:"Fields overriding the client values in completion requests"`
+	Forbidden     []string       `yaml:"forbidden,flow" description:"Fields stripped from completion requests"`
+	MaxTokens     int            `yaml:"max_tokens" description:"Default max_tokens cap, 0 for no cap"`
+	UserMaxTokens map[string]int `yaml:"user_max_tokens" description:"Per-user max_tokens caps by login, the user is identified by the login cookie or the login token sent as the API key, anonymous clients get max_tokens; n_predict and max_completion_tokens are capped too"`
+}
+
 type Config struct {
-	CredFilename string `yaml:"accounts" description:"Credentials filename" required:"true"`
-	Domain       string `yaml:"domain" description:"Main domain"`
-	Address      string `yaml:"address" description:"Listen at this address"`
-	LoRAPath     string `yaml:"lora_uploads" description:"Path to the directory for LoRA uploads"`
-	LoginHeader  string `yaml:"login_header" description:"Title text for login page"`
-	LoginTitle   string `yaml:"login_title" description:"Login page invitation text"`
-	SDTimeout    int    `yaml:"sd_timeout" description:"SD task timeout in seconds"`
-	FIFOPath     string `yaml:"fifo_path" description:"Path to FIFO controlling instance restarts"`
-	CookieFile   string `yaml:"cookie_file" description:"Path to the cookie storage file"`
-	PushPassword string `yaml:"push_password" description:"Password to push prometheus metrics from other services"`
-	StaticPath   string `yaml:"static_path" description:"Path to the static pages (each dir will be available at corresponding /dir URL)"`
-	ACL          ACL    `yaml:"acl,flow" description:"Mapping of user names to a list or roles or * for full access"`
-	StatusToken  string `yaml:"status_token" description:"Token for /q/status.json endpoint auth"`
+	CredFilename string                   `yaml:"accounts" description:"Credentials filename" required:"true"`
+	Domain       string                   `yaml:"domain" description:"Main domain"`
+	Address      string                   `yaml:"address" description:"Listen at this address"`
+	LoRAPath     string                   `yaml:"lora_uploads" description:"Path to the directory for LoRA uploads"`
+	Categories   []upload.Category        `yaml:"model_categories" description:"Upload categories (checkpoints, embeddings, VAE etc.) with optional per-directory and per-user quotas, LoRA uploads only if empty"`
+	LoginHeader  string                   `yaml:"login_header" description:"Title text for login page"`
+	LoginTitle   string                   `yaml:"login_title" description:"Login page invitation text"`
+	SDTimeout    int                      `yaml:"sd_timeout" description:"SD task timeout in seconds"`
+	FIFOPath     string                   `yaml:"fifo_path" description:"Path to FIFO controlling instance restarts"`
+	CookieFile   string                   `yaml:"cookie_file" description:"Path to the cookie storage file"`
+	DLWorkers    int                      `yaml:"download_workers" description:"Number of parallel remote downloads"`
+	DLSources    upload.SourcesConfig     `yaml:"download_sources" description:"Remote download sources (civitai, huggingface, direct) with allowlists and API tokens, the CivitAI token is preferred and the cookie is the fallback if it is rejected"`
+	TrashDays    int                      `yaml:"trash_days" description:"Days to keep the deleted model files in trash"`
+	CivitAI      civitai.ClientConfig     `yaml:"civitai" description:"CivitAI API site (base_url, hosts), API key, user_agent, request rate, metadata mirror directory and offline mode"`
+	BaseModels   []civitai.BaseModelRule  `yaml:"base_models" description:"Mapping of CivitAI base model name prefixes to sd version values, built-in table if empty"`
+	Previews     civitai.PreviewConfig    `yaml:"model_previews" description:"CivitAI preview selection (max_nsfw_level), PNG conversion, thumbnail size and gallery size"`
+	PushPassword string                   `yaml:"push_password" description:"Password to push prometheus metrics from other services"`
+	StaticPath   string                   `yaml:"static_path" description:"Path to the static pages (each dir will be available at corresponding /dir URL)"`
+	ACL          ACL                      `yaml:"acl,flow" description:"Mapping of user names to a list or roles or * for full access, @role grants a custom role"`
+	StatusToken  string                   `yaml:"status_token" description:"Token for /q/status.json endpoint auth"`
+	Vision       VisionConfig             `yaml:"vision" description:"Image preprocessing for vision LLM requests"`
+	LLMPolicy    LLMPolicy                `yaml:"llm_policy" description:"Request rewriting policy for LLM completions"`
+	SDLimits     map[string]SDLimit       `yaml:"sd_limits" description:"SD generation limits by user login or @role from the ACL, the user is identified by the login cookie or the login token sent as the API key, \"default\" applies to everyone else"`
+	Backends     map[string]BackendConfig `yaml:"backends" description:"Per-backend proxy settings (sd, acestep, as15, ovi, cui, vlo, sdvote, lora_previews, llm, tts)"`
+	Cache        CacheConfig              `yaml:"cache" description:"Response cache storage settings"`
 }
 
 var config = Config{
@@ -31,6 +61,20 @@ var config = Config{
 	SDTimeout:   300,
 	FIFOPath:    "/var/run/sdwd/control.fifo",
 	CookieFile:  "cookie.txt",
+	DLWorkers:   1,
+	TrashDays:   7,
+	Vision: VisionConfig{
+		MaxDimension: 2048,
+		FetchTimeout: 15,
+		MaxFetchSize: 20 * 1024 * 1024,
+		MaxPixels:    50_000_000,
+		Decoder:      []string{"magick", "-", "png:-"},
+	},
+	Cache: CacheConfig{
+		MaxEntrySize: 10 * 1024 * 1024,
+		MaxMemory:    128 * 1024 * 1024,
+		MaxDisk:      1024 * 1024 * 1024,
+	},
 }
 
 func loadConfig(filename string) error {
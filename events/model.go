@@ -15,6 +15,7 @@ const (
 	DOWNLOAD_UPDATE packetType = "download"
 	MESSAGE_UPDATE  packetType = "message"
 	SERVICE_UPDATE  packetType = "service"
+	CIRCUIT_UPDATE  packetType = "circuit"
 )
 
 type Packet struct {
@@ -41,3 +42,9 @@ type ServiceUpdate struct {
 	LastActive  time.Time            `json:"last_active"`
 	Queue       int32                `json:"service_queue"`
 }
+
+type CircuitUpdate struct {
+	Backend  string `json:"backend"`
+	State    string `json:"state"`
+	Failures int    `json:"failures"`
+}
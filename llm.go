@@ -29,20 +29,53 @@ func isLLMPath(path string) bool {
 		strings.HasSuffix(path, "/v1/internal/encode") || strings.HasSuffix(path, "/v1/embeddings") || strings.HasPrefix(path, "/upstream/")
 }
 
-func NewLLMBalancer(target *url.URL, sq *servicequeue.ServiceQueue, metricUpdater chan<- metrics.MetricUpdate) *llmbalancer {
+func isCompletionPath(path string) bool {
+	return strings.HasSuffix(path, "/v1/chat/completions") || strings.HasSuffix(path, "/v1/completions")
+}
+
+// llmRules converts images for VLM and applies the configured request policy to completion requests
+func llmRules(ic *proxy.ImageConverter, policy LLMPolicy) []proxy.Rule {
+	result := []proxy.Rule{{
+		Method:  "POST",
+		Path:    func(path string) bool { return strings.HasSuffix(path, "/v1/chat/completions") },
+		Request: []proxy.RequestTransform{ic.ConvertRequest},
+	}}
+	policyRule := proxy.Rule{Method: "POST", Path: isCompletionPath}
+	if len(policy.Forbidden) > 0 {
+		policyRule.Request = append(policyRule.Request, proxy.StripFields(policy.Forbidden...))
+	}
+	if len(policy.Defaults) > 0 {
+		policyRule.Request = append(policyRule.Request, proxy.SetDefaults(policy.Defaults))
+	}
+	if len(policy.Inject) > 0 {
+		policyRule.Request = append(policyRule.Request, proxy.Inject(policy.Inject))
+	}
+	if policy.MaxTokens > 0 || len(policy.UserMaxTokens) > 0 {
+		limit := func(c echo.Context) float64 {
+			if limit, ok := policy.UserMaxTokens[optionalUser(c)]; ok {
+				return float64(limit)
+			}
+			return float64(policy.MaxTokens)
+		}
+		// llama.cpp prefers n_predict over max_tokens and the newer OpenAI clients send max_completion_tokens
+		policyRule.Request = append(policyRule.Request, proxy.CapNumber("max_tokens", true, limit),
+			proxy.CapNumber("n_predict", false, limit), proxy.CapNumber("max_completion_tokens", false, limit))
+	}
+	if len(policyRule.Request) > 0 {
+		result = append(result, policyRule)
+	}
+	return result
+}
+
+func NewLLMBalancer(target *url.URL, sq *servicequeue.ServiceQueue, metricUpdater chan<- metrics.MetricUpdate, ic *proxy.ImageConverter, policy LLMPolicy) *llmbalancer {
 	result := llmbalancer{sq: sq, target: target, metricUpdater: metricUpdater}
-	result.proxy = proxy.NewProxyWrapper(target, &proxy.Interceptor{
+	result.proxy = proxy.NewProxyWrapper(target, backendInterceptor("llm", &proxy.Interceptor{
 		Before: func(c echo.Context) {
 			log.Printf("LLM Req: %s %s", c.Request().Method, c.Request().URL.String())
 			path := c.Request().URL.Path
 			if !isLLMPath(path) {
 				return
 			}
-			// Convert WebP to PNG in request body for VLM images
-			if err := proxy.ConvertRequestIfNeeded(c); err != nil {
-				log.Printf("Error converting request images: %s", err)
-				// Don't fail the request, just log the error
-			}
 			sq.Lock()
 			defer sq.Unlock()
 			log.Print("LLM sq locked, waiting...")
@@ -76,7 +109,8 @@ func NewLLMBalancer(target *url.URL, sq *servicequeue.ServiceQueue, metricUpdate
 			}
 			return 0
 		}),
-	})
+		Rules: llmRules(ic, policy),
+	}))
 	go result.startMetricCollection()
 	return &result
 }
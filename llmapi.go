@@ -0,0 +1,653 @@
+package main
+
+import (
+	"bytes"
+	"cmp"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/rkfg/authproxy/proxy"
+)
+
+// OpenAI chat completions structures, only the fields the facades care about
+
+type openAIMessage struct {
+	Role    string `json:"role"`
+	Content any    `json:"content"`
+}
+
+type openAIRequest struct {
+	Model          string          `json:"model,omitempty"`
+	Messages       []openAIMessage `json:"messages"`
+	MaxTokens      *int            `json:"max_tokens,omitempty"`
+	Temperature    *float64        `json:"temperature,omitempty"`
+	TopP           *float64        `json:"top_p,omitempty"`
+	TopK           *int            `json:"top_k,omitempty"`
+	Seed           *int            `json:"seed,omitempty"`
+	Stop           []string        `json:"stop,omitempty"`
+	ResponseFormat any             `json:"response_format,omitempty"`
+	Stream         bool            `json:"stream"`
+	StreamOptions  map[string]any  `json:"stream_options,omitempty"`
+}
+
+type openAIResponse struct {
+	ID      string `json:"id"`
+	Model   string `json:"model"`
+	Choices []struct {
+		Message struct {
+			Content string `json:"content"`
+		} `json:"message"`
+		Delta struct {
+			Content string `json:"content"`
+		} `json:"delta"`
+		FinishReason *string `json:"finish_reason"`
+	} `json:"choices"`
+	Usage *struct {
+		PromptTokens     int `json:"prompt_tokens"`
+		CompletionTokens int `json:"completion_tokens"`
+	} `json:"usage"`
+}
+
+func textPart(text string) map[string]any {
+	return map[string]any{"type": "text", "text": text}
+}
+
+func imagePart(url string) map[string]any {
+	return map[string]any{"type": "image_url", "image_url": map[string]any{"url": url}}
+}
+
+// simplifyContent collapses a single text part into a plain string for the backends that don't handle arrays well
+func simplifyContent(parts []map[string]any) any {
+	if len(parts) == 1 && parts[0]["type"] == "text" {
+		return parts[0]["text"]
+	}
+	return parts
+}
+
+func openAIErrorMessage(body []byte) string {
+	var e struct {
+		Error struct {
+			Message string `json:"message"`
+		} `json:"error"`
+	}
+	if json.Unmarshal(body, &e) == nil && e.Error.Message != "" {
+		return e.Error.Message
+	}
+	return strings.TrimSpace(string(body))
+}
+
+// errToolsUnsupported is returned for the requests using tools, the facades only translate the text and images
+var errToolsUnsupported = errors.New("tools are not supported")
+
+// hasTools checks if the optional list of tools or tool calls isn't empty
+func hasTools(raw json.RawMessage) bool {
+	raw = bytes.TrimSpace(raw)
+	return len(raw) > 0 && string(raw) != "null" && string(raw) != "[]"
+}
+
+// facadeTranslator converts OpenAI responses into the facade API format
+type facadeTranslator interface {
+	contentType(stream bool) string
+	response(r *openAIResponse) any
+	chunk(r *openAIResponse) []byte
+	finish() []byte
+	error(status int, msg string) any
+}
+
+// facadeWriter replaces the echo response writer while the request is proxied to translate the upstream reply
+type facadeWriter struct {
+	http.ResponseWriter
+	header   http.Header
+	t        facadeTranslator
+	status   int
+	stream   bool
+	finished bool
+	buf      bytes.Buffer
+}
+
+func (fw *facadeWriter) Header() http.Header {
+	return fw.header
+}
+
+func (fw *facadeWriter) WriteHeader(code int) {
+	fw.status = code
+	fw.stream = code == http.StatusOK && strings.HasPrefix(fw.header.Get(echo.HeaderContentType), "text/event-stream")
+	if !fw.stream {
+		return
+	}
+	h := fw.ResponseWriter.Header()
+	h.Set(echo.HeaderContentType, fw.t.contentType(true))
+	h.Set("Cache-Control", "no-cache")
+	fw.ResponseWriter.WriteHeader(code)
+}
+
+func (fw *facadeWriter) Write(b []byte) (int, error) {
+	if fw.status == 0 {
+		fw.WriteHeader(http.StatusOK)
+	}
+	fw.buf.Write(b)
+	if !fw.stream {
+		return len(b), nil
+	}
+	for {
+		line, err := fw.buf.ReadBytes('\n')
+		if err != nil { // incomplete line, keep it for the next write
+			rest := append([]byte{}, line...)
+			fw.buf.Reset()
+			fw.buf.Write(rest)
+			break
+		}
+		if err := fw.streamLine(bytes.TrimSpace(line)); err != nil {
+			return 0, err
+		}
+	}
+	return len(b), nil
+}
+
+func (fw *facadeWriter) streamLine(line []byte) error {
+	data, ok := bytes.CutPrefix(line, []byte("data:"))
+	if !ok {
+		return nil
+	}
+	data = bytes.TrimSpace(data)
+	if string(data) == "[DONE]" {
+		return fw.finish()
+	}
+	var r openAIResponse
+	if err := json.Unmarshal(data, &r); err != nil {
+		log.Printf("Error parsing upstream chunk %s: %s", data, err)
+		return nil
+	}
+	_, err := fw.ResponseWriter.Write(fw.t.chunk(&r))
+	return err
+}
+
+func (fw *facadeWriter) finish() error {
+	if fw.finished {
+		return nil
+	}
+	fw.finished = true
+	_, err := fw.ResponseWriter.Write(fw.t.finish())
+	return err
+}
+
+func (fw *facadeWriter) Flush() {
+	if fw.stream {
+		http.NewResponseController(fw.ResponseWriter).Flush()
+	}
+}
+
+// close writes the buffered non-streaming reply or terminates the stream if upstream didn't
+func (fw *facadeWriter) close() error {
+	if fw.stream {
+		return fw.finish()
+	}
+	var result any
+	if fw.status == http.StatusOK {
+		var r openAIResponse
+		if err := json.Unmarshal(fw.buf.Bytes(), &r); err != nil {
+			fw.status = http.StatusBadGateway
+			result = fw.t.error(fw.status, "invalid upstream response: "+err.Error())
+		} else {
+			result = fw.t.response(&r)
+		}
+	} else {
+		result = fw.t.error(fw.status, openAIErrorMessage(fw.buf.Bytes()))
+	}
+	body, err := json.Marshal(result)
+	if err != nil {
+		return err
+	}
+	h := fw.ResponseWriter.Header()
+	h.Set(echo.HeaderContentType, fw.t.contentType(false))
+	h.Set(echo.HeaderContentLength, fmt.Sprint(len(body)))
+	fw.ResponseWriter.WriteHeader(fw.status)
+	_, err = fw.ResponseWriter.Write(body)
+	return err
+}
+
+// proxyTranslated sends the converted request through the regular LLM proxy so it gets queued and preprocessed the same way
+func (l *llmbalancer) proxyTranslated(c echo.Context, req *openAIRequest, t facadeTranslator) error {
+	if req.Stream {
+		req.StreamOptions = map[string]any{"include_usage": true}
+	}
+	body, err := json.Marshal(req)
+	if err != nil {
+		return JSONError(c, 500, err)
+	}
+	r := c.Request()
+	r.Method = http.MethodPost
+	r.URL.Path = "/v1/chat/completions"
+	r.URL.RawPath = ""
+	r.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+	r.Header.Del(echo.HeaderAcceptEncoding)
+	r.Body = io.NopCloser(bytes.NewReader(body))
+	r.ContentLength = int64(len(body))
+	r.Header.Set(echo.HeaderContentLength, fmt.Sprint(len(body)))
+	orig := c.Response().Writer
+	fw := &facadeWriter{ResponseWriter: orig, header: http.Header{}, t: t}
+	c.Response().Writer = fw
+	err = l.proxy(func(c echo.Context) error { return nil })(c)
+	c.Response().Writer = orig
+	if err != nil && fw.status == 0 {
+		return err
+	}
+	return fw.close()
+}
+
+// Anthropic Messages API
+
+type anthropicBlock struct {
+	Type   string `json:"type"`
+	Text   string `json:"text"`
+	Source *struct {
+		Type      string `json:"type"`
+		MediaType string `json:"media_type"`
+		Data      string `json:"data"`
+		URL       string `json:"url"`
+	} `json:"source"`
+}
+
+type anthropicRequest struct {
+	Model         string          `json:"model"`
+	MaxTokens     *int            `json:"max_tokens"`
+	Temperature   *float64        `json:"temperature"`
+	TopP          *float64        `json:"top_p"`
+	TopK          *int            `json:"top_k"`
+	StopSequences []string        `json:"stop_sequences"`
+	Stream        bool            `json:"stream"`
+	System        json.RawMessage `json:"system"`
+	Tools         json.RawMessage `json:"tools"`
+	Messages      []struct {
+		Role    string          `json:"role"`
+		Content json.RawMessage `json:"content"`
+	} `json:"messages"`
+}
+
+// anthropicBlocks parses content that can be either a string or a list of blocks
+func anthropicBlocks(raw json.RawMessage) ([]anthropicBlock, error) {
+	raw = bytes.TrimSpace(raw)
+	if len(raw) == 0 || string(raw) == "null" {
+		return nil, nil
+	}
+	if raw[0] == '"' {
+		var s string
+		if err := json.Unmarshal(raw, &s); err != nil {
+			return nil, err
+		}
+		return []anthropicBlock{{Type: "text", Text: s}}, nil
+	}
+	var result []anthropicBlock
+	err := json.Unmarshal(raw, &result)
+	return result, err
+}
+
+func anthropicParts(raw json.RawMessage) ([]map[string]any, error) {
+	blocks, err := anthropicBlocks(raw)
+	if err != nil {
+		return nil, err
+	}
+	parts := []map[string]any{}
+	for _, b := range blocks {
+		switch b.Type {
+		case "text":
+			parts = append(parts, textPart(b.Text))
+		case "image":
+			if b.Source == nil {
+				continue
+			}
+			if b.Source.Type == "url" {
+				parts = append(parts, imagePart(b.Source.URL))
+			} else {
+				parts = append(parts, imagePart("data:"+b.Source.MediaType+";base64,"+b.Source.Data))
+			}
+		case "tool_use", "tool_result", "server_tool_use":
+			return nil, errToolsUnsupported
+		default:
+			log.Printf("Unsupported Anthropic content block type %s, skipping", b.Type)
+		}
+	}
+	return parts, nil
+}
+
+func anthropicStopReason(finish string) string {
+	switch finish {
+	case "length":
+		return "max_tokens"
+	default:
+		return "end_turn"
+	}
+}
+
+type anthropicTranslator struct {
+	id         string
+	model      string
+	started    bool
+	stopReason string
+	inTokens   int
+	outTokens  int
+}
+
+func anthropicEvent(typ string, data map[string]any) []byte {
+	data["type"] = typ
+	j, _ := json.Marshal(data)
+	return fmt.Appendf(nil, "event: %s\ndata: %s\n\n", typ, j)
+}
+
+func (a *anthropicTranslator) message(content []map[string]any, stopReason any) map[string]any {
+	return map[string]any{
+		"id": a.id, "type": "message", "role": "assistant", "model": a.model, "content": content,
+		"stop_reason": stopReason, "stop_sequence": nil,
+		"usage": map[string]any{"input_tokens": a.inTokens, "output_tokens": a.outTokens},
+	}
+}
+
+func (a *anthropicTranslator) contentType(stream bool) string {
+	if stream {
+		return "text/event-stream"
+	}
+	return echo.MIMEApplicationJSON
+}
+
+func (a *anthropicTranslator) usage(r *openAIResponse) {
+	if r.ID != "" {
+		a.id = r.ID
+	}
+	if r.Model != "" {
+		a.model = r.Model
+	}
+	if r.Usage != nil {
+		a.inTokens = r.Usage.PromptTokens
+		a.outTokens = r.Usage.CompletionTokens
+	}
+}
+
+func (a *anthropicTranslator) response(r *openAIResponse) any {
+	a.usage(r)
+	text := ""
+	stopReason := "end_turn"
+	if len(r.Choices) > 0 {
+		text = r.Choices[0].Message.Content
+		if r.Choices[0].FinishReason != nil {
+			stopReason = anthropicStopReason(*r.Choices[0].FinishReason)
+		}
+	}
+	return a.message([]map[string]any{textPart(text)}, stopReason)
+}
+
+func (a *anthropicTranslator) start() []byte {
+	if a.started {
+		return nil
+	}
+	a.started = true
+	result := anthropicEvent("message_start", map[string]any{"message": a.message([]map[string]any{}, nil)})
+	return append(result, anthropicEvent("content_block_start", map[string]any{"index": 0, "content_block": textPart("")})...)
+}
+
+func (a *anthropicTranslator) chunk(r *openAIResponse) []byte {
+	a.usage(r)
+	result := a.start()
+	for _, ch := range r.Choices {
+		if ch.Delta.Content != "" {
+			result = append(result, anthropicEvent("content_block_delta", map[string]any{
+				"index": 0, "delta": map[string]any{"type": "text_delta", "text": ch.Delta.Content},
+			})...)
+		}
+		if ch.FinishReason != nil {
+			a.stopReason = anthropicStopReason(*ch.FinishReason)
+		}
+	}
+	return result
+}
+
+func (a *anthropicTranslator) finish() []byte {
+	result := a.start()
+	if a.stopReason == "" {
+		a.stopReason = "end_turn"
+	}
+	result = append(result, anthropicEvent("content_block_stop", map[string]any{"index": 0})...)
+	result = append(result, anthropicEvent("message_delta", map[string]any{
+		"delta": map[string]any{"stop_reason": a.stopReason, "stop_sequence": nil},
+		"usage": map[string]any{"output_tokens": a.outTokens},
+	})...)
+	return append(result, anthropicEvent("message_stop", map[string]any{})...)
+}
+
+func (a *anthropicTranslator) error(status int, msg string) any {
+	typ := "api_error"
+	switch {
+	case status == http.StatusUnauthorized:
+		typ = "authentication_error"
+	case status == http.StatusForbidden:
+		typ = "permission_error"
+	case status == http.StatusNotFound:
+		typ = "not_found_error"
+	case status >= 400 && status < 500:
+		typ = "invalid_request_error"
+	}
+	return map[string]any{"type": "error", "error": map[string]any{"type": typ, "message": msg}}
+}
+
+func (l *llmbalancer) anthropicMessages(c echo.Context) error {
+	var req anthropicRequest
+	if err := json.NewDecoder(c.Request().Body).Decode(&req); err != nil {
+		return JSONError(c, 400, err)
+	}
+	if hasTools(req.Tools) {
+		return JSONError(c, 400, errToolsUnsupported)
+	}
+	oreq := openAIRequest{Model: req.Model, MaxTokens: req.MaxTokens, Temperature: req.Temperature, TopP: req.TopP, TopK: req.TopK, Stop: req.StopSequences, Stream: req.Stream}
+	system, err := anthropicParts(req.System)
+	if err != nil {
+		return JSONError(c, 400, err)
+	}
+	if len(system) > 0 {
+		oreq.Messages = append(oreq.Messages, openAIMessage{Role: "system", Content: simplifyContent(system)})
+	}
+	for _, m := range req.Messages {
+		parts, err := anthropicParts(m.Content)
+		if err != nil {
+			return JSONError(c, 400, err)
+		}
+		oreq.Messages = append(oreq.Messages, openAIMessage{Role: m.Role, Content: simplifyContent(parts)})
+	}
+	if c.Request().Header.Get(echo.HeaderAuthorization) == "" {
+		if key := c.Request().Header.Get("x-api-key"); key != "" {
+			c.Request().Header.Set(echo.HeaderAuthorization, "Bearer "+key)
+		}
+	}
+	return l.proxyTranslated(c, &oreq, &anthropicTranslator{id: fmt.Sprintf("msg_%d", time.Now().UnixNano()), model: req.Model})
+}
+
+// Ollama chat API
+
+type ollamaRequest struct {
+	Model    string `json:"model"`
+	Messages []struct {
+		Role      string          `json:"role"`
+		Content   string          `json:"content"`
+		Images    []string        `json:"images"`
+		ToolCalls json.RawMessage `json:"tool_calls"`
+	} `json:"messages"`
+	Tools   json.RawMessage `json:"tools"`
+	Stream  *bool           `json:"stream"`
+	Format  json.RawMessage `json:"format"`
+	Options struct {
+		Temperature *float64 `json:"temperature"`
+		TopP        *float64 `json:"top_p"`
+		TopK        *int     `json:"top_k"`
+		NumPredict  *int     `json:"num_predict"`
+		Seed        *int     `json:"seed"`
+		Stop        []string `json:"stop"`
+	} `json:"options"`
+}
+
+// ollamaImageURL turns the raw base64 image Ollama clients send into a data URL
+func ollamaImageURL(b64 string) string {
+	head, err := base64.StdEncoding.DecodeString(b64[:min(len(b64), 512)/4*4])
+	format := "*" // unknown, the image converter detects it after decoding
+	if err == nil {
+		format = cmp.Or(proxy.SniffImage(head), format)
+	}
+	return "data:image/" + format + ";base64," + b64
+}
+
+func ollamaFormat(format json.RawMessage) any {
+	format = bytes.TrimSpace(format)
+	if len(format) == 0 || string(format) == "null" || string(format) == `""` {
+		return nil
+	}
+	if string(format) == `"json"` {
+		return map[string]any{"type": "json_object"}
+	}
+	return map[string]any{"type": "json_schema", "json_schema": map[string]any{"name": "response", "schema": format}}
+}
+
+type ollamaTranslator struct {
+	model      string
+	start      time.Time
+	doneReason string
+	inTokens   int
+	outTokens  int
+}
+
+func (o *ollamaTranslator) contentType(stream bool) string {
+	if stream {
+		return "application/x-ndjson"
+	}
+	return echo.MIMEApplicationJSON
+}
+
+func (o *ollamaTranslator) message(content string, done bool) map[string]any {
+	result := map[string]any{
+		"model": o.model, "created_at": time.Now().UTC().Format(time.RFC3339Nano),
+		"message": map[string]any{"role": "assistant", "content": content}, "done": done,
+	}
+	if done {
+		result["done_reason"] = o.doneReason
+		result["total_duration"] = time.Since(o.start).Nanoseconds()
+		result["prompt_eval_count"] = o.inTokens
+		result["eval_count"] = o.outTokens
+	}
+	return result
+}
+
+func (o *ollamaTranslator) usage(r *openAIResponse) {
+	if r.Usage != nil {
+		o.inTokens = r.Usage.PromptTokens
+		o.outTokens = r.Usage.CompletionTokens
+	}
+	for _, ch := range r.Choices {
+		if ch.FinishReason != nil {
+			o.doneReason = *ch.FinishReason
+		}
+	}
+}
+
+func (o *ollamaTranslator) response(r *openAIResponse) any {
+	o.usage(r)
+	text := ""
+	if len(r.Choices) > 0 {
+		text = r.Choices[0].Message.Content
+	}
+	if o.doneReason == "" {
+		o.doneReason = "stop"
+	}
+	return o.message(text, true)
+}
+
+func (o *ollamaTranslator) line(v any) []byte {
+	j, _ := json.Marshal(v)
+	return append(j, '\n')
+}
+
+func (o *ollamaTranslator) chunk(r *openAIResponse) []byte {
+	o.usage(r)
+	var result []byte
+	for _, ch := range r.Choices {
+		if ch.Delta.Content != "" {
+			result = append(result, o.line(o.message(ch.Delta.Content, false))...)
+		}
+	}
+	return result
+}
+
+func (o *ollamaTranslator) finish() []byte {
+	if o.doneReason == "" {
+		o.doneReason = "stop"
+	}
+	return o.line(o.message("", true))
+}
+
+func (o *ollamaTranslator) error(status int, msg string) any {
+	return map[string]any{"error": msg}
+}
+
+func (l *llmbalancer) ollamaChat(c echo.Context) error {
+	var req ollamaRequest
+	if err := json.NewDecoder(c.Request().Body).Decode(&req); err != nil {
+		return c.JSON(400, map[string]any{"error": err.Error()})
+	}
+	if hasTools(req.Tools) {
+		return c.JSON(400, map[string]any{"error": errToolsUnsupported.Error()})
+	}
+	oreq := openAIRequest{Model: req.Model, MaxTokens: req.Options.NumPredict, Temperature: req.Options.Temperature, TopP: req.Options.TopP,
+		TopK: req.Options.TopK, Seed: req.Options.Seed, Stop: req.Options.Stop, Stream: req.Stream == nil || *req.Stream, ResponseFormat: ollamaFormat(req.Format)}
+	for _, m := range req.Messages {
+		if m.Role == "tool" || hasTools(m.ToolCalls) {
+			return c.JSON(400, map[string]any{"error": errToolsUnsupported.Error()})
+		}
+		if len(m.Images) == 0 {
+			oreq.Messages = append(oreq.Messages, openAIMessage{Role: m.Role, Content: m.Content})
+			continue
+		}
+		parts := []map[string]any{textPart(m.Content)}
+		for _, img := range m.Images {
+			parts = append(parts, imagePart(ollamaImageURL(img)))
+		}
+		oreq.Messages = append(oreq.Messages, openAIMessage{Role: m.Role, Content: parts})
+	}
+	return l.proxyTranslated(c, &oreq, &ollamaTranslator{model: req.Model, start: time.Now()})
+}
+
+func (l *llmbalancer) ollamaTags(c echo.Context) error {
+	req, err := http.NewRequestWithContext(c.Request().Context(), http.MethodGet, l.target.JoinPath("/v1/models").String(), nil)
+	if err != nil {
+		return c.JSON(500, map[string]any{"error": err.Error()})
+	}
+	// the route skips the authentication so the upstream checks the API key
+	if auth := c.Request().Header.Get(echo.HeaderAuthorization); auth != "" {
+		req.Header.Set(echo.HeaderAuthorization, auth)
+	}
+	resp, err := l.client.Do(req)
+	if err != nil {
+		return c.JSON(502, map[string]any{"error": err.Error()})
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 64*1024))
+		return c.JSON(resp.StatusCode, map[string]any{"error": openAIErrorMessage(body)})
+	}
+	var models struct {
+		Data []struct {
+			ID      string `json:"id"`
+			Created int64  `json:"created"`
+		} `json:"data"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&models); err != nil {
+		return c.JSON(502, map[string]any{"error": err.Error()})
+	}
+	result := []map[string]any{}
+	for _, m := range models.Data {
+		result = append(result, map[string]any{"name": m.ID, "model": m.ID, "modified_at": time.Unix(m.Created, 0).UTC().Format(time.RFC3339)})
+	}
+	return c.JSON(200, map[string]any{"models": result})
+}
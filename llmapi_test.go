@@ -0,0 +1,266 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+// recorded llama.cpp replies
+const (
+	openAIStream = `data: {"id":"chatcmpl-1","object":"chat.completion.chunk","model":"qwen","choices":[{"index":0,"delta":{"role":"assistant","content":null},"finish_reason":null}]}
+
+data: {"id":"chatcmpl-1","object":"chat.completion.chunk","model":"qwen","choices":[{"index":0,"delta":{"content":"Hel"},"finish_reason":null}]}
+
+data: {"id":"chatcmpl-1","object":"chat.completion.chunk","model":"qwen","choices":[{"index":0,"delta":{"content":"lo"},"finish_reason":null}]}
+
+data: {"id":"chatcmpl-1","object":"chat.completion.chunk","model":"qwen","choices":[{"index":0,"delta":{},"finish_reason":"length"}]}
+
+data: {"id":"chatcmpl-1","object":"chat.completion.chunk","model":"qwen","choices":[],"usage":{"prompt_tokens":12,"completion_tokens":2,"total_tokens":14}}
+
+data: [DONE]
+
+`
+	openAIStreamNoDone = `data: {"id":"chatcmpl-2","model":"qwen","choices":[{"index":0,"delta":{"content":"Hi"},"finish_reason":"stop"}]}
+
+`
+	openAIResponseBody = `{"id":"chatcmpl-3","object":"chat.completion","created":1760000000,"model":"qwen",` +
+		`"choices":[{"index":0,"message":{"role":"assistant","content":"Hello"},"finish_reason":"stop"}],` +
+		`"usage":{"prompt_tokens":12,"completion_tokens":1,"total_tokens":13}}`
+	openAIErrorBody = `{"error":{"code":400,"message":"the request exceeds the available context size","type":"invalid_request_error"}}`
+)
+
+// facadeReply is the part of the translated reply the tests compare
+type facadeReply struct {
+	Status int
+	Events []string
+	Text   string
+	Stop   string
+	Model  string
+	Out    int
+	Error  string
+}
+
+func anthropicReply(t *testing.T, status int, body []byte) facadeReply {
+	result := facadeReply{Status: status}
+	message := func(m map[string]any) {
+		result.Model, _ = m["model"].(string)
+		if content, ok := m["content"].([]any); ok && len(content) > 0 {
+			result.Text += content[0].(map[string]any)["text"].(string)
+		}
+		if stop, ok := m["stop_reason"].(string); ok {
+			result.Stop = stop
+		}
+		result.Out = int(m["usage"].(map[string]any)["output_tokens"].(float64))
+	}
+	scanner := bufio.NewScanner(bytes.NewReader(body))
+	for scanner.Scan() {
+		line := scanner.Text()
+		if strings.HasPrefix(line, "{") { // non-streaming reply
+			line = "data: " + line
+		}
+		data, ok := strings.CutPrefix(line, "data: ")
+		if !ok {
+			continue
+		}
+		var ev map[string]any
+		if err := json.Unmarshal([]byte(data), &ev); err != nil {
+			t.Fatalf("invalid event %s: %s", data, err)
+		}
+		typ := ev["type"].(string)
+		result.Events = append(result.Events, typ)
+		switch typ {
+		case "message":
+			message(ev)
+		case "message_start":
+			message(ev["message"].(map[string]any))
+		case "content_block_delta":
+			result.Text += ev["delta"].(map[string]any)["text"].(string)
+		case "message_delta":
+			result.Stop = ev["delta"].(map[string]any)["stop_reason"].(string)
+			result.Out = int(ev["usage"].(map[string]any)["output_tokens"].(float64))
+		case "error":
+			result.Error = ev["error"].(map[string]any)["type"].(string) + ": " + ev["error"].(map[string]any)["message"].(string)
+		}
+	}
+	return result
+}
+
+func ollamaReply(t *testing.T, status int, body []byte) facadeReply {
+	result := facadeReply{Status: status}
+	scanner := bufio.NewScanner(bytes.NewReader(body))
+	for scanner.Scan() {
+		var ev struct {
+			Model   string `json:"model"`
+			Message struct {
+				Content string `json:"content"`
+			} `json:"message"`
+			Done       bool   `json:"done"`
+			DoneReason string `json:"done_reason"`
+			EvalCount  int    `json:"eval_count"`
+			Error      string `json:"error"`
+		}
+		if err := json.Unmarshal(scanner.Bytes(), &ev); err != nil {
+			t.Fatalf("invalid line %s: %s", scanner.Text(), err)
+		}
+		if ev.Error != "" {
+			result.Events = append(result.Events, "error")
+			result.Error = ev.Error
+			continue
+		}
+		result.Model = ev.Model
+		result.Text += ev.Message.Content
+		if ev.Done {
+			result.Events = append(result.Events, "done")
+			result.Stop, result.Out = ev.DoneReason, ev.EvalCount
+		} else {
+			result.Events = append(result.Events, "chunk")
+		}
+	}
+	return result
+}
+
+func TestFacadeWriter(t *testing.T) {
+	anthropicStream := []string{"message_start", "content_block_start", "content_block_delta", "content_block_delta", "content_block_stop", "message_delta", "message_stop"}
+	tests := []struct {
+		name        string
+		translator  func() facadeTranslator
+		reply       func(t *testing.T, status int, body []byte) facadeReply
+		status      int
+		contentType string
+		body        string
+		want        facadeReply
+	}{
+		{
+			name:       "anthropic stream",
+			translator: func() facadeTranslator { return &anthropicTranslator{id: "msg_1", model: "claude"} },
+			reply:      anthropicReply, status: 200, contentType: "text/event-stream", body: openAIStream,
+			want: facadeReply{Status: 200, Events: anthropicStream, Text: "Hello", Stop: "max_tokens", Model: "qwen", Out: 2},
+		},
+		{
+			name:       "anthropic stream without done",
+			translator: func() facadeTranslator { return &anthropicTranslator{id: "msg_1", model: "claude"} },
+			reply:      anthropicReply, status: 200, contentType: "text/event-stream", body: openAIStreamNoDone,
+			want: facadeReply{Status: 200, Events: slices.Delete(slices.Clone(anthropicStream), 3, 4), Text: "Hi", Stop: "end_turn", Model: "qwen"},
+		},
+		{
+			name:       "anthropic response",
+			translator: func() facadeTranslator { return &anthropicTranslator{id: "msg_1", model: "claude"} },
+			reply:      anthropicReply, status: 200, contentType: "application/json", body: openAIResponseBody,
+			want: facadeReply{Status: 200, Events: []string{"message"}, Text: "Hello", Stop: "end_turn", Model: "qwen", Out: 1},
+		},
+		{
+			name:       "anthropic error",
+			translator: func() facadeTranslator { return &anthropicTranslator{id: "msg_1", model: "claude"} },
+			reply:      anthropicReply, status: 400, contentType: "application/json", body: openAIErrorBody,
+			want: facadeReply{Status: 400, Events: []string{"error"}, Error: "invalid_request_error: the request exceeds the available context size"},
+		},
+		{
+			name:       "anthropic invalid response",
+			translator: func() facadeTranslator { return &anthropicTranslator{id: "msg_1", model: "claude"} },
+			reply:      anthropicReply, status: 200, contentType: "application/json", body: "<html>",
+			want: facadeReply{Status: 502, Events: []string{"error"}, Error: "api_error: invalid upstream response: invalid character '<' looking for beginning of value"},
+		},
+		{
+			name:       "ollama stream",
+			translator: func() facadeTranslator { return &ollamaTranslator{model: "llama", start: time.Now()} },
+			reply:      ollamaReply, status: 200, contentType: "text/event-stream", body: openAIStream,
+			want: facadeReply{Status: 200, Events: []string{"chunk", "chunk", "done"}, Text: "Hello", Stop: "length", Model: "llama", Out: 2},
+		},
+		{
+			name:       "ollama stream without done",
+			translator: func() facadeTranslator { return &ollamaTranslator{model: "llama", start: time.Now()} },
+			reply:      ollamaReply, status: 200, contentType: "text/event-stream", body: openAIStreamNoDone,
+			want: facadeReply{Status: 200, Events: []string{"chunk", "done"}, Text: "Hi", Stop: "stop", Model: "llama"},
+		},
+		{
+			name:       "ollama response",
+			translator: func() facadeTranslator { return &ollamaTranslator{model: "llama", start: time.Now()} },
+			reply:      ollamaReply, status: 200, contentType: "application/json", body: openAIResponseBody,
+			want: facadeReply{Status: 200, Events: []string{"done"}, Text: "Hello", Stop: "stop", Model: "llama", Out: 1},
+		},
+		{
+			name:       "ollama error",
+			translator: func() facadeTranslator { return &ollamaTranslator{model: "llama", start: time.Now()} },
+			reply:      ollamaReply, status: 400, contentType: "application/json", body: openAIErrorBody,
+			want: facadeReply{Status: 400, Events: []string{"error"}, Error: "the request exceeds the available context size"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			fw := &facadeWriter{ResponseWriter: rec, header: http.Header{}, t: tt.translator()}
+			fw.Header().Set(echo.HeaderContentType, tt.contentType)
+			fw.WriteHeader(tt.status)
+			// small writes split the lines like the upstream chunks do
+			for body := []byte(tt.body); len(body) > 0; body = body[min(len(body), 37):] {
+				if _, err := fw.Write(body[:min(len(body), 37)]); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := fw.close(); err != nil {
+				t.Fatal(err)
+			}
+			got := tt.reply(t, rec.Code, rec.Body.Bytes())
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("reply %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestFacadeTools(t *testing.T) {
+	l := &llmbalancer{}
+	tests := []struct {
+		name    string
+		handler echo.HandlerFunc
+		body    string
+	}{
+		{
+			name: "anthropic tools", handler: l.anthropicMessages,
+			body: `{"model":"claude","max_tokens":100,"tools":[{"name":"get_weather","input_schema":{"type":"object"}}],"messages":[{"role":"user","content":"Weather?"}]}`,
+		},
+		{
+			name: "anthropic tool use", handler: l.anthropicMessages,
+			body: `{"model":"claude","max_tokens":100,"messages":[{"role":"assistant","content":[{"type":"tool_use","id":"toolu_1","name":"get_weather","input":{}}]}]}`,
+		},
+		{
+			name: "anthropic tool result", handler: l.anthropicMessages,
+			body: `{"model":"claude","max_tokens":100,"messages":[{"role":"user","content":[{"type":"tool_result","tool_use_id":"toolu_1","content":"Sunny"}]}]}`,
+		},
+		{
+			name: "ollama tools", handler: l.ollamaChat,
+			body: `{"model":"llama","tools":[{"type":"function","function":{"name":"get_weather"}}],"messages":[{"role":"user","content":"Weather?"}]}`,
+		},
+		{
+			name: "ollama tool calls", handler: l.ollamaChat,
+			body: `{"model":"llama","messages":[{"role":"assistant","content":"","tool_calls":[{"function":{"name":"get_weather","arguments":{}}}]}]}`,
+		},
+		{
+			name: "ollama tool result", handler: l.ollamaChat,
+			body: `{"model":"llama","messages":[{"role":"tool","content":"Sunny"}]}`,
+		},
+	}
+	e := echo.New()
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			c := e.NewContext(httptest.NewRequest(http.MethodPost, "/", strings.NewReader(tt.body)), rec)
+			if err := tt.handler(c); err != nil {
+				t.Fatal(err)
+			}
+			if rec.Code != http.StatusBadRequest || !strings.Contains(rec.Body.String(), errToolsUnsupported.Error()) {
+				t.Errorf("got %d %s, want the tools error", rec.Code, rec.Body)
+			}
+		})
+	}
+}
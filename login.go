@@ -76,6 +76,14 @@ func failLogin(c echo.Context, username string) error {
 	return c.Redirect(302, "/login"+q)
 }
 
+// parseToken validates the login token, it's used by the auth middleware and to identify the users on the routes
+// that skip it
+func parseToken(auth string) (*jwt.Token, error) {
+	return jwt.Parse(auth, func(t *jwt.Token) (any, error) {
+		return []byte(params.JWTSecret), nil
+	}, jwt.WithValidMethods([]string{jwt.SigningMethodHS256.Alg()}))
+}
+
 func setToken(c echo.Context, subject string) error {
 	expiration := time.Now().AddDate(0, 0, expirationDays)
 	token := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.RegisteredClaims{ExpiresAt: jwt.NewNumericDate(expiration), Subject: subject})
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"cmp"
 	"log"
 	"math/rand"
 	"net/http"
@@ -11,10 +12,10 @@ import (
 	"time"
 
 	"github.com/btcsuite/go-flags"
-	"github.com/golang-jwt/jwt/v5"
 	echojwt "github.com/labstack/echo-jwt/v4"
 	"github.com/labstack/echo/v4"
 	"github.com/labstack/echo/v4/middleware"
+	"github.com/rkfg/authproxy/civitai"
 	"github.com/rkfg/authproxy/events"
 	"github.com/rkfg/authproxy/metrics"
 	"github.com/rkfg/authproxy/progress"
@@ -33,23 +34,12 @@ var params struct {
 	JWTSecret      string
 }
 
-var domains = map[string]echo.MiddlewareFunc{
-	"":               proxy.NewProxyWrapperStr(SD_URL, nil),
-	"acestep.":       proxy.NewProxyWrapperStr(AS10_URL, nil),
-	"as15.":          proxy.NewProxyWrapperStr(AS15_URL, nil),
-	"ovi.":           proxy.NewProxyWrapperStr(OVI_URL, nil),
-	"cui.":           proxy.NewProxyWrapperStr(CUI_URL, nil),
-	"vlo.":           proxy.NewProxyWrapperStr(VLO_URL, nil),
-	"/vote2025hw":    proxy.NewProxyWrapperStr(SDVOTE_URL, nil),
-	"/lora_previews": proxy.NewProxyWrapperStr(CADDY_URL, nil),
-}
-
 var skipAuth = map[string][]string{
 	"path": {
 		"/login", "/metrics", "/internal/join", "/internal/leave", "/internal/free_complete", "/cui/join", "/cui/leave", "/cui/progress", "/acestep/join", "/acestep/leave", "/acestep15/join", "/acestep15/leave", "/ovi/join", "/ovi/leave", "/q/status.json",
 	},
 	"prefix": {
-		"/v1/", "/sdapi/",
+		"/v1/", "/sdapi/", "/ollama/",
 	},
 }
 
@@ -99,7 +89,9 @@ func main() {
 	e := echo.New()
 	mchan := metrics.NewMetrics(e, config.PushPassword)
 	e.Use(echojwt.WithConfig(echojwt.Config{
-		SigningKey:   []byte(params.JWTSecret),
+		ParseTokenFunc: func(c echo.Context, auth string) (any, error) {
+			return parseToken(auth)
+		},
 		ErrorHandler: keyErrorHandler,
 		TokenLookup:  "cookie:" + cookieName,
 		Skipper: func(c echo.Context) bool {
@@ -125,16 +117,9 @@ func main() {
 		LogUserAgent:    true,
 		LogResponseSize: true,
 		LogValuesFunc: func(c echo.Context, v middleware.RequestLoggerValues) error {
-			token := c.Get("user")
-			user := "???"
-			if token != nil {
-				claims := token.(*jwt.Token).Claims
-				if claims != nil {
-					subject, err := claims.GetSubject()
-					if err == nil && subject != "" {
-						user = subject
-					}
-				}
+			user := userFromContext(c)
+			if user == "" {
+				user = "???"
 			}
 			log.Printf("%s %s %s %s %d %d %s", v.RemoteIP, user, v.Method, v.URI, v.Status, v.ResponseSize, v.UserAgent)
 			return nil
@@ -145,6 +130,9 @@ func main() {
 	e.GET("/logout", logoutHandler)
 	e.POST("/login", loginHandler)
 	broker := events.NewBroker()
+	backendEvents.broker = broker
+	backendEvents.metrics = mchan
+	domains := newDomains()
 	wd := watchdog.NewWatchdog(config.FIFOPath)
 	svcChan := make(chan servicequeue.SvcUpdate)
 	sq := servicequeue.NewServiceQueue(svcChan)
@@ -180,20 +168,53 @@ func main() {
 			e.Group(d, earlyCheckMiddleware(d), trail, t)
 		}
 	}
-	e.Group("/sdapi", domains[config.Domain])
+	e.Group("/sdapi", domains[""])
 	addSDQueueHandlers(e, sq)
 	addASQueueHandlers(e, sq)
 	addOviQueueHandlers(e, sq)
 	if llmurl.Scheme != "" {
-		llm := NewLLMBalancer(llmurl, sq, mchan)
+		llm := NewLLMBalancer(llmurl, sq, mchan, proxy.NewImageConverter(proxy.ImageOptions{
+			MaxDimension: config.Vision.MaxDimension,
+			FetchTimeout: time.Second * time.Duration(config.Vision.FetchTimeout),
+			MaxFetchSize: config.Vision.MaxFetchSize,
+			MaxPixels:    config.Vision.MaxPixels,
+			Decoder:      config.Vision.Decoder,
+		}), config.LLMPolicy)
 		e.Group("/v1/*", llm.proxy)
 		e.Group("/upstream/*", llm.proxy)
 		e.POST("/v1/internal/encode", nil, llm.proxy)
 		e.Any("/v1/internal/*", llm.forbidden)
 		e.GET("/v1/models/*", llm.forbidden)
+		e.POST("/v1/messages", llm.anthropicMessages)
+		e.POST("/ollama/api/chat", llm.ollamaChat)
+		e.GET("/ollama/api/tags", llm.ollamaTags)
+	}
+	categories := config.Categories
+	if len(categories) == 0 && config.LoRAPath != "" {
+		categories = []upload.Category{upload.DefaultCategory(config.LoRAPath)}
 	}
-	if config.LoRAPath != "" {
-		upload.NewUploader(e.Group("/upload"), config.LoRAPath, config.CookieFile, broker, mchan)
+	if len(categories) > 0 {
+		civitaiConfig := config.CivitAI
+		civitaiConfig.Token = cmp.Or(civitaiConfig.Token, config.DLSources.CivitAI.Token)
+		if config.DLSources.CivitAI.BaseURL != "" {
+			log.Print("download_sources.civitai.base_url is deprecated, use civitai.base_url")
+			civitaiConfig.BaseURL = cmp.Or(civitaiConfig.BaseURL, config.DLSources.CivitAI.BaseURL)
+		}
+		upload.NewUploader(e.Group("/upload"), upload.Config{
+			Categories: categories,
+			CookieFile: config.CookieFile,
+			User:       userFromContext,
+			Workers:    config.DLWorkers,
+			Sources:    config.DLSources,
+			AdminRole:  "admin",
+			Retention:  time.Hour * 24 * time.Duration(config.TrashDays),
+			BaseModels: config.BaseModels,
+			Previews:   config.Previews,
+			CivitAI:    civitai.NewClient(civitaiConfig),
+			HasRole: func(c echo.Context, role string) bool {
+				return hasRole(userFromContext(c), role)
+			},
+		}, broker, mchan)
 	}
 	if TTS_URL != "" {
 		ttsurl, err := url.Parse(TTS_URL)
@@ -11,7 +11,7 @@ import (
 
 type Metrics struct {
 	reg          prometheus.Registerer
-	metrics      map[MetricID]prometheus.Metric
+	metrics      map[MetricID]prometheus.Collector
 	updater      chan MetricUpdate
 	pushPassword string
 }
@@ -28,17 +28,23 @@ const (
 	UPLOAD_COUNT
 	UPLOAD_SIZE
 	LLM_TOKENS
+	CIRCUIT_STATE
 )
 
 type MetricUpdate struct {
-	Type  MetricID
-	Value float64
+	Type   MetricID
+	Value  float64
+	Labels []string // for vector metrics
 }
 
 func (m *Metrics) start() {
 	for u := range m.updater {
 		if metric, ok := m.metrics[u.Type]; ok {
 			switch t := metric.(type) {
+			case *prometheus.GaugeVec:
+				t.WithLabelValues(u.Labels...).Set(u.Value)
+			case *prometheus.CounterVec:
+				t.WithLabelValues(u.Labels...).Add(u.Value)
 			case prometheus.Gauge:
 				t.Set(u.Value)
 			case prometheus.Counter:
@@ -51,7 +57,7 @@ func (m *Metrics) start() {
 }
 
 func (m *Metrics) register(id MetricID, t prometheus.ValueType, name string, help string) {
-	var newMetric prometheus.Metric
+	var newMetric prometheus.Collector
 	switch t {
 	case prometheus.CounterValue:
 		newMetric = prometheus.NewCounter(prometheus.CounterOpts{Name: name, Help: help})
@@ -61,7 +67,21 @@ func (m *Metrics) register(id MetricID, t prometheus.ValueType, name string, hel
 		panic(fmt.Sprintf("Unknown metric value type: %d", t))
 	}
 	m.metrics[id] = newMetric
-	m.reg.MustRegister(newMetric.(prometheus.Collector))
+	m.reg.MustRegister(newMetric)
+}
+
+func (m *Metrics) registerVec(id MetricID, t prometheus.ValueType, name string, help string, labels ...string) {
+	var newMetric prometheus.Collector
+	switch t {
+	case prometheus.CounterValue:
+		newMetric = prometheus.NewCounterVec(prometheus.CounterOpts{Name: name, Help: help}, labels)
+	case prometheus.GaugeValue:
+		newMetric = prometheus.NewGaugeVec(prometheus.GaugeOpts{Name: name, Help: help}, labels)
+	default:
+		panic(fmt.Sprintf("Unknown metric value type: %d", t))
+	}
+	m.metrics[id] = newMetric
+	m.reg.MustRegister(newMetric)
 }
 
 func (m *Metrics) handleMetricPush(c echo.Context) error {
@@ -87,7 +107,7 @@ func (m *Metrics) handleMetricPush(c echo.Context) error {
 }
 
 func NewMetrics(e *echo.Echo, pushPassword string) chan<- MetricUpdate {
-	m := Metrics{reg: prometheus.NewRegistry(), metrics: map[MetricID]prometheus.Metric{}, updater: make(chan MetricUpdate, 100), pushPassword: pushPassword}
+	m := Metrics{reg: prometheus.NewRegistry(), metrics: map[MetricID]prometheus.Collector{}, updater: make(chan MetricUpdate, 100), pushPassword: pushPassword}
 	m.register(TASKS_COMPLETED, prometheus.CounterValue, "tasks_completed", "Number of tasks processed")
 	m.register(GPU_ACTIVE_TIME, prometheus.CounterValue, "gpu_active_time", "Number of seconds the GPU was spinning")
 	m.register(QUEUE_LENGTH, prometheus.GaugeValue, "queue_length", "Number of tasks queued for processing")
@@ -97,6 +117,7 @@ func NewMetrics(e *echo.Echo, pushPassword string) chan<- MetricUpdate {
 	m.register(UPLOAD_COUNT, prometheus.CounterValue, "upload_count", "Number of LoRAs uploaded")
 	m.register(UPLOAD_SIZE, prometheus.CounterValue, "upload_size", "Total size of LoRAs uploaded")
 	m.register(LLM_TOKENS, prometheus.CounterValue, "llm_tokens", "Total number of tokens generated with the LLM")
+	m.registerVec(CIRCUIT_STATE, prometheus.GaugeValue, "circuit_state", "Upstream circuit breaker state (0 closed, 1 open, 2 half-open)", "backend")
 
 	h := promhttp.HandlerFor(m.reg.(prometheus.Gatherer), promhttp.HandlerOpts{Registry: m.reg})
 	e.GET("/metrics", func(c echo.Context) error {
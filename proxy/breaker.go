@@ -0,0 +1,189 @@
+package proxy
+
+import (
+	"errors"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+type BreakerState int
+
+const (
+	BreakerClosed BreakerState = iota
+	BreakerOpen
+	BreakerHalfOpen
+)
+
+func (s BreakerState) String() string {
+	switch s {
+	case BreakerClosed:
+		return "closed"
+	case BreakerOpen:
+		return "open"
+	case BreakerHalfOpen:
+		return "half-open"
+	default:
+		return "<unknown>"
+	}
+}
+
+var ErrCircuitOpen = errors.New("circuit breaker is open")
+
+type TransportOptions struct {
+	ConnectTimeout        time.Duration
+	ResponseHeaderTimeout time.Duration
+	Retries               int           // retries of idempotent requests
+	RetryBackoff          time.Duration // doubles after every attempt
+	BreakerThreshold      int           // consecutive failures to open the breaker, 0 disables it
+	BreakerCooldown       time.Duration // time before a probe request is let through the open breaker
+	OnStateChange         func(state BreakerState, failures int)
+}
+
+// upstreamTransport retries failed idempotent requests and stops forwarding to the upstream that keeps failing
+type upstreamTransport struct {
+	http.RoundTripper
+	opts     TransportOptions
+	m        sync.Mutex
+	state    BreakerState
+	failures int
+	openedAt time.Time
+	probing  bool
+	changes  chan stateChange // delivers the state changes to OnStateChange in order
+}
+
+type stateChange struct {
+	state    BreakerState
+	failures int
+}
+
+func NewTransport(opts TransportOptions) http.RoundTripper {
+	t := http.DefaultTransport.(*http.Transport).Clone()
+	if opts.ConnectTimeout > 0 {
+		t.DialContext = (&net.Dialer{Timeout: opts.ConnectTimeout, KeepAlive: 30 * time.Second}).DialContext
+	}
+	t.ResponseHeaderTimeout = opts.ResponseHeaderTimeout
+	result := &upstreamTransport{RoundTripper: t, opts: opts}
+	if opts.OnStateChange != nil {
+		result.changes = make(chan stateChange, 16)
+		go func() {
+			for c := range result.changes {
+				opts.OnStateChange(c.state, c.failures)
+			}
+		}()
+	}
+	return result
+}
+
+func (t *upstreamTransport) setState(s BreakerState) {
+	if t.state == s {
+		return
+	}
+	t.state = s
+	if s == BreakerOpen {
+		t.openedAt = time.Now()
+	}
+	if t.changes != nil { // sent under the lock so the callback sees the changes in order
+		t.changes <- stateChange{state: s, failures: t.failures}
+	}
+}
+
+func (t *upstreamTransport) allow() error {
+	if t.opts.BreakerThreshold <= 0 {
+		return nil
+	}
+	t.m.Lock()
+	defer t.m.Unlock()
+	switch t.state {
+	case BreakerOpen:
+		if time.Since(t.openedAt) < t.opts.BreakerCooldown {
+			return ErrCircuitOpen
+		}
+		t.setState(BreakerHalfOpen)
+		t.probing = true
+	case BreakerHalfOpen:
+		if t.probing {
+			return ErrCircuitOpen
+		}
+		t.probing = true
+	}
+	return nil
+}
+
+func (t *upstreamTransport) report(ok bool) {
+	if t.opts.BreakerThreshold <= 0 {
+		return
+	}
+	t.m.Lock()
+	defer t.m.Unlock()
+	t.probing = false
+	if ok {
+		t.failures = 0
+		t.setState(BreakerClosed)
+		return
+	}
+	t.failures++
+	if t.state == BreakerHalfOpen || t.failures >= t.opts.BreakerThreshold {
+		t.setState(BreakerOpen)
+	}
+}
+
+// release lets another probe through without changing the breaker state
+func (t *upstreamTransport) release() {
+	t.m.Lock()
+	defer t.m.Unlock()
+	t.probing = false
+}
+
+func isIdempotent(req *http.Request) bool {
+	switch req.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions:
+		return req.Body == nil || req.Body == http.NoBody
+	}
+	return false
+}
+
+func upstreamFailed(resp *http.Response, err error) bool {
+	return err != nil || resp.StatusCode == http.StatusBadGateway || resp.StatusCode == http.StatusServiceUnavailable || resp.StatusCode == http.StatusGatewayTimeout
+}
+
+func (t *upstreamTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if err := t.allow(); err != nil {
+		return nil, err
+	}
+	attempts := 1
+	if isIdempotent(req) {
+		attempts += t.opts.Retries
+	}
+	backoff := t.opts.RetryBackoff
+	for a := 1; ; a++ {
+		resp, err := t.RoundTripper.RoundTrip(req)
+		if req.Context().Err() != nil { // client is gone, not the upstream's fault
+			t.release()
+			return resp, err
+		}
+		if !upstreamFailed(resp, err) {
+			t.report(true)
+			return resp, nil
+		}
+		if a >= attempts {
+			t.report(false)
+			return resp, err
+		}
+		if resp != nil {
+			io.Copy(io.Discard, resp.Body)
+			resp.Body.Close()
+		}
+		log.Printf("Request to %s failed (attempt %d/%d), retrying in %s", req.URL, a, attempts, backoff)
+		select {
+		case <-time.After(backoff):
+		case <-req.Context().Done():
+			t.release()
+			return nil, req.Context().Err()
+		}
+		backoff *= 2
+	}
+}
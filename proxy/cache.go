@@ -0,0 +1,332 @@
+package proxy
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/gob"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+type CacheRule struct {
+	Path  func(path string) bool
+	TTL   time.Duration
+	Query []string // parameters that form the cache key, the requests with other parameters aren't cached
+}
+
+type cacheEntry struct {
+	Status int
+	Header http.Header
+	Body   []byte
+	Stored time.Time
+}
+
+type cacheStore interface {
+	get(key string) *cacheEntry
+	put(key string, e *cacheEntry)
+}
+
+// Cache stores successful GET responses and serves them while fresh, stale entries are served if the upstream fails
+type Cache struct {
+	rules        []CacheRule
+	store        cacheStore
+	maxEntrySize int64
+}
+
+// NewCache creates an on-disk cache in dir limited to maxDisk bytes or an in-memory one limited to maxMemory bytes if
+// dir is empty
+func NewCache(rules []CacheRule, dir string, maxEntrySize int64, maxMemory int64, maxDisk int64) *Cache {
+	result := &Cache{rules: rules, maxEntrySize: maxEntrySize}
+	if dir != "" {
+		store, err := newDiskStore(dir, maxDisk)
+		if err != nil {
+			log.Printf("Error opening cache directory %s: %s, falling back to memory", dir, err)
+		} else {
+			result.store = store
+			return result
+		}
+	}
+	result.store = &memoryStore{entries: map[string]*cacheEntry{}, maxSize: maxMemory}
+	return result
+}
+
+func (ch *Cache) rule(req *http.Request) *CacheRule {
+	if ch == nil || req.Method != http.MethodGet {
+		return nil
+	}
+	for idx := range ch.rules {
+		if ch.rules[idx].Path(req.URL.Path) {
+			for param := range req.URL.Query() {
+				if !slices.Contains(ch.rules[idx].Query, param) {
+					return nil
+				}
+			}
+			return &ch.rules[idx]
+		}
+	}
+	return nil
+}
+
+// cacheKey is the path with the sorted query so the same parameters in a different order share the entry, the rule
+// has already rejected the unknown parameters
+func cacheKey(req *http.Request) string {
+	query := req.URL.Query().Encode()
+	if query == "" {
+		return req.URL.Path
+	}
+	return req.URL.Path + "?" + query
+}
+
+func (ch *Cache) serve(c echo.Context, e *cacheEntry, state string) error {
+	h := c.Response().Header()
+	for k, v := range e.Header {
+		h[k] = v
+	}
+	h.Set("X-Cache", state)
+	c.Response().WriteHeader(e.Status)
+	_, err := c.Response().Write(e.Body)
+	return err
+}
+
+// serveFresh writes the cached response if it's not expired, returns true if the request was handled
+func (ch *Cache) serveFresh(c echo.Context) (bool, error) {
+	req := c.Request()
+	r := ch.rule(req)
+	if r == nil {
+		return false, nil
+	}
+	req.Header.Del(echo.HeaderAcceptEncoding) // keep the cached bodies uncompressed
+	e := ch.store.get(cacheKey(req))
+	if e == nil || time.Since(e.Stored) > r.TTL {
+		return false, nil
+	}
+	return true, ch.serve(c, e, "HIT")
+}
+
+// serveStale writes the cached response regardless of its age, returns true if the request was handled
+func (ch *Cache) serveStale(c echo.Context) (bool, error) {
+	if ch.rule(c.Request()) == nil || c.Response().Committed {
+		return false, nil
+	}
+	e := ch.store.get(cacheKey(c.Request()))
+	if e == nil {
+		return false, nil
+	}
+	log.Printf("Serving stale %s", c.Request().URL.Path)
+	return true, ch.serve(c, e, "STALE")
+}
+
+// update stores the successful responses and replaces the failed ones with the stale entries
+func (ch *Cache) update(resp *http.Response) error {
+	if resp == nil || resp.Request == nil || ch.rule(resp.Request) == nil {
+		return nil
+	}
+	key := cacheKey(resp.Request)
+	if resp.StatusCode >= 500 {
+		if e := ch.store.get(key); e != nil {
+			log.Printf("Upstream returned %d for %s, serving stale", resp.StatusCode, resp.Request.URL.Path)
+			resp.Body.Close()
+			resp.StatusCode = e.Status
+			resp.Status = fmt.Sprintf("%d %s", e.Status, http.StatusText(e.Status))
+			resp.Header = e.Header.Clone()
+			resp.Header.Set("X-Cache", "STALE")
+			resp.Body = io.NopCloser(bytes.NewReader(e.Body))
+			resp.ContentLength = int64(len(e.Body))
+		}
+		return nil
+	}
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("Set-Cookie") != "" || resp.Header.Get(echo.HeaderContentEncoding) != "" ||
+		isStreaming(resp) || resp.ContentLength > ch.maxEntrySize {
+		return nil
+	}
+	body, err := io.ReadAll(io.LimitReader(resp.Body, ch.maxEntrySize+1))
+	if err != nil {
+		return err
+	}
+	if int64(len(body)) > ch.maxEntrySize { // too big, pass through the rest without caching
+		resp.Body = struct {
+			io.Reader
+			io.Closer
+		}{io.MultiReader(bytes.NewReader(body), resp.Body), resp.Body}
+		return nil
+	}
+	resp.Body.Close()
+	resp.Body = io.NopCloser(bytes.NewReader(body))
+	header := resp.Header.Clone()
+	header.Del("Date")
+	ch.store.put(key, &cacheEntry{Status: resp.StatusCode, Header: header, Body: body, Stored: time.Now()})
+	resp.Header.Set("X-Cache", "MISS")
+	return nil
+}
+
+type memoryStore struct {
+	sync.Mutex
+	entries map[string]*cacheEntry
+	size    int64
+	maxSize int64
+}
+
+func (m *memoryStore) get(key string) *cacheEntry {
+	m.Lock()
+	defer m.Unlock()
+	return m.entries[key]
+}
+
+func (m *memoryStore) put(key string, e *cacheEntry) {
+	m.Lock()
+	defer m.Unlock()
+	if old, ok := m.entries[key]; ok {
+		m.size -= int64(len(old.Body))
+	}
+	m.entries[key] = e
+	m.size += int64(len(e.Body))
+	for m.size > m.maxSize && len(m.entries) > 1 { // evict the oldest entries
+		oldestKey := ""
+		for k, v := range m.entries {
+			if oldestKey == "" || v.Stored.Before(m.entries[oldestKey].Stored) {
+				oldestKey = k
+			}
+		}
+		m.size -= int64(len(m.entries[oldestKey].Body))
+		delete(m.entries, oldestKey)
+	}
+}
+
+type diskFile struct {
+	size int64
+	used time.Time
+}
+
+// diskStore keeps the entries in files named by the key hash, the least recently used ones are removed when the
+// total size exceeds maxSize
+type diskStore struct {
+	sync.Mutex
+	dir     string
+	files   map[string]*diskFile
+	size    int64
+	maxSize int64
+}
+
+func newDiskStore(dir string, maxSize int64) (*diskStore, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	result := &diskStore{dir: dir, files: map[string]*diskFile{}, maxSize: maxSize}
+	for _, e := range entries {
+		if e.IsDir() {
+			continue
+		}
+		if strings.HasPrefix(e.Name(), ".tmp-") { // left after a crash
+			os.Remove(filepath.Join(dir, e.Name()))
+			continue
+		}
+		fi, err := e.Info()
+		if err != nil {
+			continue
+		}
+		result.files[e.Name()] = &diskFile{size: fi.Size(), used: fi.ModTime()}
+		result.size += fi.Size()
+	}
+	result.Lock()
+	result.evict()
+	result.Unlock()
+	return result, nil
+}
+
+func (d *diskStore) filename(key string) string {
+	return fmt.Sprintf("%x", sha256.Sum256([]byte(key)))
+}
+
+// remove deletes the file and its index entry, must be called with the lock held
+func (d *diskStore) remove(name string) {
+	if f, ok := d.files[name]; ok {
+		d.size -= f.size
+		delete(d.files, name)
+	}
+	os.Remove(filepath.Join(d.dir, name))
+}
+
+// evict removes the least recently used files until the size fits, must be called with the lock held
+func (d *diskStore) evict() {
+	for d.size > d.maxSize && len(d.files) > 1 {
+		oldest := ""
+		for name, f := range d.files {
+			if oldest == "" || f.used.Before(d.files[oldest].used) {
+				oldest = name
+			}
+		}
+		d.remove(oldest)
+	}
+}
+
+func (d *diskStore) get(key string) *cacheEntry {
+	name := d.filename(key)
+	d.Lock()
+	f, ok := d.files[name]
+	if ok {
+		f.used = time.Now()
+	}
+	d.Unlock()
+	if !ok {
+		return nil
+	}
+	data, err := os.ReadFile(filepath.Join(d.dir, name))
+	if err != nil {
+		d.Lock()
+		d.remove(name)
+		d.Unlock()
+		return nil
+	}
+	var e cacheEntry
+	if err := gob.NewDecoder(bytes.NewReader(data)).Decode(&e); err != nil {
+		log.Printf("Error reading cache entry for %s: %s", key, err)
+		return nil
+	}
+	return &e
+}
+
+func (d *diskStore) put(key string, e *cacheEntry) {
+	f, err := os.CreateTemp(d.dir, ".tmp-*")
+	if err != nil {
+		log.Printf("Error creating cache entry for %s: %s", key, err)
+		return
+	}
+	defer os.Remove(f.Name())
+	err = gob.NewEncoder(f).Encode(e)
+	var size int64
+	if err == nil {
+		size, err = f.Seek(0, io.SeekCurrent)
+	}
+	f.Close()
+	if err != nil {
+		log.Printf("Error writing cache entry for %s: %s", key, err)
+		return
+	}
+	name := d.filename(key)
+	d.Lock()
+	defer d.Unlock()
+	if err := os.Rename(f.Name(), filepath.Join(d.dir, name)); err != nil {
+		log.Printf("Error saving cache entry for %s: %s", key, err)
+		return
+	}
+	if old, ok := d.files[name]; ok {
+		d.size -= old.size
+	}
+	d.files[name] = &diskFile{size: size, used: time.Now()}
+	d.size += size
+	d.evict()
+}
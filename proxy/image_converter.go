@@ -2,115 +2,294 @@ package proxy
 
 import (
 	"bytes"
+	"context"
 	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"image"
 	"image/draw"
+	_ "image/gif"
+	"image/jpeg"
 	"image/png"
 	"io"
+	"log"
+	"net"
 	"net/http"
+	"os/exec"
 	"strings"
+	"syscall"
+	"time"
 
 	"github.com/labstack/echo/v4"
-	"golang.org/x/image/webp"
+	_ "golang.org/x/image/bmp"
+	xdraw "golang.org/x/image/draw"
+	_ "golang.org/x/image/tiff"
+	_ "golang.org/x/image/webp"
 )
 
-// setRequestBody sets the request body and updates headers
-func setRequestBody(req *http.Request, body []byte) {
-	req.Body = io.NopCloser(bytes.NewReader(body))
-	req.ContentLength = int64(len(body))
-	req.Header.Set("Content-Length", fmt.Sprintf("%d", len(body)))
+// ImageOptions control how images in vision requests are normalized before they reach the backend
+type ImageOptions struct {
+	MaxDimension int           // downscale images so that the longest side fits, 0 disables
+	FetchTimeout time.Duration // timeout for downloading remote image URLs
+	MaxFetchSize int64         // maximum size of a remote or inline image
+	MaxPixels    int           // maximum width×height of the decoded image, protects from decompression bombs
+	Decoder      []string      // command converting formats Go can't decode (AVIF, HEIC) from stdin to PNG on stdout
+}
+
+type ImageConverter struct {
+	opts   ImageOptions
+	client *http.Client
+}
+
+// sharedAddressSpace is the carrier-grade NAT range (RFC 6598) not covered by net.IP.IsPrivate
+var sharedAddressSpace = &net.IPNet{IP: net.IPv4(100, 64, 0, 0), Mask: net.CIDRMask(10, 32)}
+
+// publicOnly prevents fetching images from the internal network on behalf of the clients
+func publicOnly(network, address string, _ syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	ip := net.ParseIP(host)
+	if ip == nil || ip.IsLoopback() || ip.IsPrivate() || ip.IsUnspecified() || ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() || ip.IsMulticast() ||
+		sharedAddressSpace.Contains(ip) {
+		return fmt.Errorf("address %s is not allowed", address)
+	}
+	return nil
+}
+
+func NewImageConverter(opts ImageOptions) *ImageConverter {
+	dialer := &net.Dialer{Timeout: opts.FetchTimeout, Control: publicOnly}
+	return &ImageConverter{opts: opts, client: &http.Client{
+		Timeout:   opts.FetchTimeout,
+		Transport: &http.Transport{DialContext: dialer.DialContext, TLSHandshakeTimeout: opts.FetchTimeout},
+	}}
 }
 
 // processImageURL processes an image URL and returns true if it was modified
-func processImageURL(content map[string]any) bool {
+func (ic *ImageConverter) processImageURL(content map[string]any) (bool, error) {
 	if content["type"] == "image_url" {
 		if imageURL, ok := content["image_url"].(map[string]any); ok {
 			if url, ok := imageURL["url"].(string); ok {
-				if newURL, err := convertImageURL(url); err == nil {
-					if newURL != url {
-						imageURL["url"] = newURL
-						return true
-					}
+				newURL, err := ic.convertImageURL(url)
+				if err != nil {
+					return false, err
+				}
+				if newURL != url {
+					imageURL["url"] = newURL
+					return true, nil
 				}
 			}
 		}
 	}
-	return false
+	return false, nil
 }
 
-// convertWebPToPNG converts WebP image data to PNG format
-func convertWebPToPNG(webpData []byte) ([]byte, error) {
-	img, err := webp.Decode(bytes.NewReader(webpData))
-	if err != nil {
-		return nil, fmt.Errorf("failed to decode WebP image: %w", err)
+// SniffImage returns the image format by its signature, including the formats that need the external decoder
+func SniffImage(data []byte) string {
+	switch {
+	case bytes.HasPrefix(data, []byte("\x89PNG")):
+		return "png"
+	case bytes.HasPrefix(data, []byte("\xff\xd8\xff")):
+		return "jpeg"
+	case bytes.HasPrefix(data, []byte("GIF8")):
+		return "gif"
+	case bytes.HasPrefix(data, []byte("BM")):
+		return "bmp"
+	case bytes.HasPrefix(data, []byte("II*\x00")), bytes.HasPrefix(data, []byte("MM\x00*")):
+		return "tiff"
+	case len(data) >= 12 && string(data[:4]) == "RIFF" && string(data[8:12]) == "WEBP":
+		return "webp"
+	case len(data) >= 12 && string(data[4:8]) == "ftyp":
+		switch string(data[8:12]) {
+		case "avif", "avis":
+			return "avif"
+		case "heic", "heix", "hevc", "hevx", "mif1", "msf1":
+			return "heic"
+		}
 	}
+	return ""
+}
 
-	bounds := img.Bounds()
-	rgba := image.NewRGBA(bounds)
-	draw.Draw(rgba, bounds, img, bounds.Min, draw.Src)
-
-	buf := new(bytes.Buffer)
-	if err := png.Encode(buf, rgba); err != nil {
-		return nil, fmt.Errorf("failed to encode PNG image: %w", err)
+// decodeExternal runs the configured decoder for the formats not supported by the standard library
+func (ic *ImageConverter) decodeExternal(data []byte, format string) (image.Image, error) {
+	if len(ic.opts.Decoder) == 0 {
+		return nil, fmt.Errorf("no decoder configured for %s", format)
 	}
-
-	return buf.Bytes(), nil
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*30)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, ic.opts.Decoder[0], ic.opts.Decoder[1:]...)
+	cmd.Stdin = bytes.NewReader(data)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode %s image: %w (%s)", format, err, strings.TrimSpace(stderr.String()))
+	}
+	if _, err := ic.imageConfig(out, "png"); err != nil {
+		return nil, err
+	}
+	return png.Decode(bytes.NewReader(out))
 }
 
-// convertImageURL converts a single image URL from WebP to PNG
-func convertImageURL(url string) (string, error) {
-	if !strings.HasPrefix(url, "data:image/webp;") {
-		return url, nil
+// imageConfig reads the image dimensions and rejects the images too big to decode
+func (ic *ImageConverter) imageConfig(data []byte, format string) (image.Config, error) {
+	cfg, _, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return cfg, fmt.Errorf("failed to decode %s image: %w", format, err)
 	}
-
-	parts := strings.Split(url, ",")
-	if len(parts) != 2 {
-		return url, nil
+	if ic.opts.MaxPixels > 0 && cfg.Width*cfg.Height > ic.opts.MaxPixels {
+		return cfg, fmt.Errorf("%s image %dx%d is bigger than %d pixels", format, cfg.Width, cfg.Height, ic.opts.MaxPixels)
 	}
+	return cfg, nil
+}
 
-	webpData, err := base64.StdEncoding.DecodeString(parts[1])
+// normalizeImage converts the image to PNG or JPEG and downscales it if needed, returns nil if the data can be used as is
+func (ic *ImageConverter) normalizeImage(data []byte) ([]byte, string, error) {
+	format := SniffImage(data)
+	if format == "" {
+		return nil, "", fmt.Errorf("unknown image format")
+	}
+	if format != "avif" && format != "heic" {
+		cfg, err := ic.imageConfig(data, format)
+		if err != nil {
+			return nil, "", err
+		}
+		if (format == "png" || format == "jpeg") &&
+			(ic.opts.MaxDimension <= 0 || max(cfg.Width, cfg.Height) <= ic.opts.MaxDimension) {
+			return nil, format, nil
+		}
+	}
+	var img image.Image
+	var err error
+	if format == "avif" || format == "heic" {
+		img, err = ic.decodeExternal(data, format)
+	} else {
+		img, _, err = image.Decode(bytes.NewReader(data)) // only the first frame for GIF
+	}
 	if err != nil {
-		return url, fmt.Errorf("failed to decode base64: %w", err)
+		return nil, "", fmt.Errorf("failed to decode %s image: %w", format, err)
+	}
+	bounds := img.Bounds()
+	dst := image.NewRGBA(bounds)
+	if w, h := bounds.Dx(), bounds.Dy(); ic.opts.MaxDimension > 0 && max(w, h) > ic.opts.MaxDimension {
+		scale := float64(ic.opts.MaxDimension) / float64(max(w, h))
+		dst = image.NewRGBA(image.Rect(0, 0, max(1, int(float64(w)*scale)), max(1, int(float64(h)*scale))))
+		xdraw.CatmullRom.Scale(dst, dst.Bounds(), img, bounds, draw.Src, nil)
+	} else {
+		draw.Draw(dst, bounds, img, bounds.Min, draw.Src)
+	}
+	buf := new(bytes.Buffer)
+	if format == "jpeg" {
+		err = jpeg.Encode(buf, dst, &jpeg.Options{Quality: 90})
+	} else {
+		format = "png"
+		err = png.Encode(buf, dst)
 	}
-
-	pngData, err := convertWebPToPNG(webpData)
 	if err != nil {
-		return url, fmt.Errorf("failed to convert WebP to PNG: %w", err)
+		return nil, "", fmt.Errorf("failed to encode %s image: %w", format, err)
 	}
-
-	pngB64 := base64.StdEncoding.EncodeToString(pngData)
-	return "data:image/png;base64," + pngB64, nil
+	return buf.Bytes(), format, nil
 }
 
-// ConvertRequestIfNeeded converts WebP images to PNG in chat completions requests
-func ConvertRequestIfNeeded(c echo.Context) error {
-	if c.Request().Method != "POST" {
-		return nil
+// fetchImage downloads a remote image since the backend has no internet access
+func (ic *ImageConverter) fetchImage(url string) ([]byte, error) {
+	resp, err := ic.client.Get(url)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch image: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("failed to fetch image %s: code %d", url, resp.StatusCode)
 	}
+	if ic.opts.MaxFetchSize > 0 && resp.ContentLength > ic.opts.MaxFetchSize {
+		return nil, fmt.Errorf("image %s is too big: %d bytes", url, resp.ContentLength)
+	}
+	r := io.Reader(resp.Body)
+	if ic.opts.MaxFetchSize > 0 {
+		r = io.LimitReader(resp.Body, ic.opts.MaxFetchSize+1)
+	}
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch image %s: %w", url, err)
+	}
+	if ic.opts.MaxFetchSize > 0 && int64(len(data)) > ic.opts.MaxFetchSize {
+		return nil, fmt.Errorf("image %s is too big", url)
+	}
+	return data, nil
+}
 
-	path := c.Request().URL.Path
-	if !strings.HasSuffix(path, "/v1/chat/completions") {
-		return nil
+// convertImageURL inlines remote images and converts the unsupported formats to PNG
+func (ic *ImageConverter) convertImageURL(url string) (string, error) {
+	var data []byte
+	var err error
+	remote := false
+	switch {
+	case strings.HasPrefix(url, "data:image/"):
+		parts := strings.SplitN(url, ",", 2)
+		if len(parts) != 2 || !strings.HasSuffix(parts[0], ";base64") {
+			return url, nil
+		}
+		data, err = base64.StdEncoding.DecodeString(parts[1])
+		if err != nil {
+			return url, fmt.Errorf("failed to decode base64: %w", err)
+		}
+		if ic.opts.MaxFetchSize > 0 && int64(len(data)) > ic.opts.MaxFetchSize {
+			return url, fmt.Errorf("inline image is too big: %d bytes", len(data))
+		}
+	case strings.HasPrefix(url, "http://"), strings.HasPrefix(url, "https://"):
+		data, err = ic.fetchImage(url)
+		if err != nil {
+			return url, err
+		}
+		remote = true
+	default:
+		return url, nil
+	}
+	converted, format, err := ic.normalizeImage(data)
+	if err != nil {
+		return url, err
+	}
+	if converted == nil {
+		if !remote {
+			return url, nil
+		}
+		converted = data
 	}
+	return "data:image/" + format + ";base64," + base64.StdEncoding.EncodeToString(converted), nil
+}
 
-	bodyBytes, err := io.ReadAll(c.Request().Body)
+// ConvertRequest is a RequestTransform normalizing images in chat completions requests, the requests with images that
+// can't be used are rejected, other errors are logged and the original body is passed through
+func (ic *ImageConverter) ConvertRequest(c echo.Context, body []byte) ([]byte, error) {
+	result, err := ic.convertBody(body)
 	if err != nil {
-		return err
+		var he *echo.HTTPError
+		if errors.As(err, &he) {
+			return nil, err
+		}
+		log.Printf("Error converting request images: %s", err)
+		return body, nil
 	}
+	return result, nil
+}
 
-	c.Request().Body.Close()
+func imageError(err error) error {
+	log.Printf("Rejecting request image: %s", err)
+	return echo.NewHTTPError(http.StatusBadRequest, "Invalid image: "+err.Error())
+}
 
+func (ic *ImageConverter) convertBody(bodyBytes []byte) ([]byte, error) {
 	var requestData map[string]json.RawMessage
 	if err := json.Unmarshal(bodyBytes, &requestData); err != nil {
-		return err
+		return nil, err
 	}
 
 	if messagesJSON, ok := requestData["messages"]; ok {
 		var messages []map[string]any
 		if err := json.Unmarshal(messagesJSON, &messages); err != nil {
-			return err
+			return nil, err
 		}
 
 		modified := false
@@ -120,18 +299,22 @@ func ConvertRequestIfNeeded(c echo.Context) error {
 
 			// Process map content (single image_url object)
 			if contentMap, ok := content.(map[string]any); ok {
-				if processImageURL(contentMap) {
-					modified = true
+				changed, err := ic.processImageURL(contentMap)
+				if err != nil {
+					return nil, imageError(err)
 				}
+				modified = modified || changed
 			}
 
 			// Process array content (multi-modal messages)
 			if contentArray, ok := content.([]any); ok {
 				for _, item := range contentArray {
 					if itemMap, ok := item.(map[string]any); ok {
-						if processImageURL(itemMap) {
-							modified = true
+						changed, err := ic.processImageURL(itemMap)
+						if err != nil {
+							return nil, imageError(err)
 						}
+						modified = modified || changed
 					}
 				}
 			}
@@ -140,18 +323,12 @@ func ConvertRequestIfNeeded(c echo.Context) error {
 		if modified {
 			updatedMessages, err := json.Marshal(messages)
 			if err != nil {
-				return err
+				return nil, err
 			}
 			requestData["messages"] = updatedMessages
-			updatedBody, err := json.Marshal(requestData)
-			if err != nil {
-				return err
-			}
-			setRequestBody(c.Request(), updatedBody)
-		} else {
-			setRequestBody(c.Request(), bodyBytes)
+			return json.Marshal(requestData)
 		}
 	}
 
-	return nil
+	return bodyBytes, nil
 }
@@ -9,8 +9,12 @@ import (
 )
 
 type Interceptor struct {
-	Before func(c echo.Context)
-	After  func(req *http.Request, resp *http.Response) error
+	Before      func(c echo.Context)
+	After       func(req *http.Request, resp *http.Response) error
+	Rules       []Rule
+	Cache       *Cache
+	Maintenance *Maintenance
+	Transport   http.RoundTripper
 }
 
 type proxyWrapper struct {
@@ -34,7 +38,12 @@ func NewProxyWrapperStr(targetURL string, i *Interceptor) echo.MiddlewareFunc {
 }
 
 func NewProxyWrapper(targetURL *url.URL, i *Interceptor) echo.MiddlewareFunc {
-	return middleware.ProxyWithConfig(middleware.ProxyConfig{
+	var transport http.RoundTripper
+	if i != nil {
+		transport = i.Transport
+	}
+	pm := middleware.ProxyWithConfig(middleware.ProxyConfig{
+		Transport: transport,
 		Balancer: &proxyWrapper{ProxyBalancer: middleware.NewRoundRobinBalancer([]*middleware.ProxyTarget{
 			{URL: targetURL},
 		}), i: i},
@@ -44,13 +53,44 @@ func NewProxyWrapper(targetURL *url.URL, i *Interceptor) echo.MiddlewareFunc {
 					return err
 				}
 			}
+			if i != nil {
+				if served, err := i.Cache.serveStale(c); served {
+					return err
+				}
+				if served, err := i.Maintenance.serve(c, err); served {
+					return err
+				}
+			}
 			return err
 		},
 		ModifyResponse: func(r *http.Response) error {
+			if err := i.transformResponse(r); err != nil {
+				return err
+			}
+			if i != nil {
+				if err := i.Cache.update(r); err != nil {
+					return err
+				}
+			}
 			if i != nil && i.After != nil {
 				return i.After(r.Request, r)
 			}
 			return nil
 		},
 	})
+	if i == nil || (len(i.Rules) == 0 && i.Cache == nil) {
+		return pm
+	}
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		h := pm(next)
+		return func(c echo.Context) error {
+			if served, err := i.Cache.serveFresh(c); served {
+				return err
+			}
+			if err := i.transformRequest(c); err != nil {
+				return err
+			}
+			return h(c)
+		}
+	}
 }
@@ -0,0 +1,74 @@
+package proxy
+
+import (
+	"embed"
+	"errors"
+	"html/template"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/labstack/echo/v4/middleware"
+	"github.com/rkfg/authproxy/events"
+)
+
+//go:embed templates/*
+var templates embed.FS
+
+var maintenanceTpl = template.Must(template.ParseFS(templates, "templates/maintenance.html"))
+
+// Maintenance replaces the upstream connection errors with a page telling the service is restarting
+type Maintenance struct {
+	Title      string
+	Name       string
+	RetryAfter time.Duration
+	Status     func() *events.ServiceUpdate
+}
+
+type maintenanceData struct {
+	Title      string
+	Name       string
+	RetryAfter int
+	Status     *events.ServiceUpdate
+}
+
+// upstreamDown checks if the upstream isn't running, other errors such as the failed response transforms are real
+// bugs and aren't hidden behind the maintenance page
+func upstreamDown(err error) bool {
+	if errors.Is(err, ErrCircuitOpen) || errors.Is(err, syscall.ECONNREFUSED) {
+		return true
+	}
+	var oe *net.OpError
+	return errors.As(err, &oe) && oe.Op == "dial"
+}
+
+// serve writes the maintenance page for browsers or a JSON error for API clients, returns true if the request was handled
+func (m *Maintenance) serve(c echo.Context, err error) (bool, error) {
+	if m == nil || c.Response().Committed {
+		return false, nil
+	}
+	var he *echo.HTTPError
+	if errors.As(err, &he) && he.Code == middleware.StatusCodeContextCanceled || !upstreamDown(err) {
+		return false, nil
+	}
+	data := maintenanceData{Title: m.Title, Name: m.Name, RetryAfter: max(1, int(m.RetryAfter.Seconds()))}
+	if m.Status != nil {
+		data.Status = m.Status()
+	}
+	c.Response().Header().Set("Retry-After", strconv.Itoa(data.RetryAfter))
+	if strings.Contains(c.Request().Header.Get(echo.HeaderAccept), echo.MIMETextHTML) {
+		c.Response().Header().Set(echo.HeaderContentType, echo.MIMETextHTMLCharsetUTF8)
+		c.Response().WriteHeader(http.StatusServiceUnavailable)
+		return true, maintenanceTpl.Execute(c.Response(), data)
+	}
+	return true, c.JSON(http.StatusServiceUnavailable, map[string]any{
+		"message":     "service " + m.Name + " is unavailable, retry later",
+		"service":     m.Name,
+		"retry_after": data.RetryAfter,
+		"status":      data.Status,
+	})
+}
@@ -0,0 +1,309 @@
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"path"
+	"strings"
+
+	"github.com/labstack/echo/v4"
+)
+
+// RequestTransform rewrites the request body, returning *echo.HTTPError rejects the request with that code
+type RequestTransform func(c echo.Context, body []byte) ([]byte, error)
+
+// ResponseTransform rewrites a complete (non-streaming) response body
+type ResponseTransform func(resp *http.Response, body []byte) ([]byte, error)
+
+// StreamTransform rewrites a single line of a streaming (SSE or NDJSON) response, returning nil drops the line
+type StreamTransform func(resp *http.Response, line []byte) ([]byte, error)
+
+// Rule applies the transforms in order to the requests matching the method and path
+type Rule struct {
+	Method   string                 // empty matches any method
+	Path     func(path string) bool // nil matches any path
+	Request  []RequestTransform
+	Response []ResponseTransform
+	Stream   []StreamTransform
+}
+
+// MatchPaths returns a path checker for path.Match patterns, patterns ending with / match everything under them
+func MatchPaths(patterns ...string) func(path string) bool {
+	return func(p string) bool {
+		for _, pattern := range patterns {
+			if strings.HasSuffix(pattern, "/") && strings.HasPrefix(p, pattern) {
+				return true
+			}
+			if ok, _ := path.Match(pattern, p); ok {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+func (r *Rule) matches(req *http.Request) bool {
+	return (r.Method == "" || r.Method == req.Method) && (r.Path == nil || r.Path(req.URL.Path))
+}
+
+func (i *Interceptor) matchingRules(req *http.Request) (result []*Rule) {
+	if i == nil {
+		return nil
+	}
+	for idx := range i.Rules {
+		if i.Rules[idx].matches(req) {
+			result = append(result, &i.Rules[idx])
+		}
+	}
+	return
+}
+
+func (i *Interceptor) transformRequest(c echo.Context) error {
+	req := c.Request()
+	var body []byte
+	loaded := false
+	for _, r := range i.matchingRules(req) {
+		if len(r.Response) > 0 || len(r.Stream) > 0 {
+			req.Header.Del(echo.HeaderAcceptEncoding) // we can't rewrite compressed responses
+		}
+		for _, t := range r.Request {
+			if !loaded {
+				var err error
+				if body, err = io.ReadAll(req.Body); err != nil {
+					return err
+				}
+				req.Body.Close()
+				loaded = true
+			}
+			var err error
+			if body, err = t(c, body); err != nil {
+				return err
+			}
+		}
+	}
+	if loaded {
+		setRequestBody(req, body)
+	}
+	return nil
+}
+
+// setRequestBody sets the request body and updates headers
+func setRequestBody(req *http.Request, body []byte) {
+	req.Body = io.NopCloser(bytes.NewReader(body))
+	req.ContentLength = int64(len(body))
+	req.TransferEncoding = nil
+	req.Header.Set("Content-Length", fmt.Sprintf("%d", len(body)))
+}
+
+func isStreaming(resp *http.Response) bool {
+	ct := resp.Header.Get(echo.HeaderContentType)
+	return strings.HasPrefix(ct, "text/event-stream") || strings.HasPrefix(ct, "application/x-ndjson")
+}
+
+func (i *Interceptor) transformResponse(resp *http.Response) error {
+	if resp == nil || resp.Request == nil {
+		return nil
+	}
+	var transforms []ResponseTransform
+	var streamTransforms []StreamTransform
+	for _, r := range i.matchingRules(resp.Request) {
+		transforms = append(transforms, r.Response...)
+		streamTransforms = append(streamTransforms, r.Stream...)
+	}
+	if resp.Header.Get(echo.HeaderContentEncoding) != "" && (len(transforms) > 0 || len(streamTransforms) > 0) {
+		log.Printf("Response for %s is encoded, skipping transforms", resp.Request.URL.Path)
+		return nil
+	}
+	if isStreaming(resp) {
+		if len(streamTransforms) > 0 {
+			resp.Body = &lineTransformer{ReadCloser: resp.Body, r: bufio.NewReader(resp.Body), resp: resp, transforms: streamTransforms}
+			resp.ContentLength = -1
+			resp.Header.Del(echo.HeaderContentLength)
+		}
+		return nil
+	}
+	if len(transforms) == 0 {
+		return nil
+	}
+	body, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return err
+	}
+	for _, t := range transforms {
+		if body, err = t(resp, body); err != nil {
+			return err
+		}
+	}
+	resp.Body = io.NopCloser(bytes.NewReader(body))
+	resp.ContentLength = int64(len(body))
+	resp.Header.Set(echo.HeaderContentLength, fmt.Sprint(len(body)))
+	return nil
+}
+
+// lineTransformer applies stream transforms to every line of the response body as it's read
+type lineTransformer struct {
+	io.ReadCloser
+	r          *bufio.Reader
+	resp       *http.Response
+	transforms []StreamTransform
+	pending    []byte
+	err        error
+}
+
+func (l *lineTransformer) Read(p []byte) (int, error) {
+	for len(l.pending) == 0 {
+		if l.err != nil {
+			return 0, l.err
+		}
+		line, err := l.r.ReadBytes('\n')
+		l.err = err
+		for _, t := range l.transforms {
+			if len(line) == 0 {
+				break
+			}
+			if line, err = t(l.resp, line); err != nil {
+				l.err = err
+				break
+			}
+		}
+		l.pending = line
+	}
+	n := copy(p, l.pending)
+	l.pending = l.pending[n:]
+	return n, nil
+}
+
+func decodeObject(body []byte) (map[string]any, error) {
+	dec := json.NewDecoder(bytes.NewReader(body))
+	dec.UseNumber()
+	var data map[string]any
+	if err := dec.Decode(&data); err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+// JSONRequest adapts a function working with the decoded JSON object, empty and non-object bodies are passed through
+func JSONRequest(f func(c echo.Context, data map[string]any) error) RequestTransform {
+	return func(c echo.Context, body []byte) ([]byte, error) {
+		if len(bytes.TrimSpace(body)) == 0 {
+			return body, nil
+		}
+		data, err := decodeObject(body)
+		if err != nil {
+			return body, nil
+		}
+		if err := f(c, data); err != nil {
+			return nil, err
+		}
+		return json.Marshal(data)
+	}
+}
+
+// JSONResponse adapts a function working with the decoded JSON response object
+func JSONResponse(f func(resp *http.Response, data map[string]any) error) ResponseTransform {
+	return func(resp *http.Response, body []byte) ([]byte, error) {
+		data, err := decodeObject(body)
+		if err != nil {
+			return body, nil
+		}
+		if err := f(resp, data); err != nil {
+			return nil, err
+		}
+		return json.Marshal(data)
+	}
+}
+
+// SSEData adapts a function working with the JSON payload of SSE "data:" lines and NDJSON lines
+func SSEData(f func(resp *http.Response, data map[string]any) error) StreamTransform {
+	return func(resp *http.Response, line []byte) ([]byte, error) {
+		payload, isSSE := bytes.CutPrefix(line, []byte("data:"))
+		payload = bytes.TrimSpace(payload)
+		if len(payload) == 0 || payload[0] != '{' {
+			return line, nil
+		}
+		data, err := decodeObject(payload)
+		if err != nil {
+			return line, nil
+		}
+		if err := f(resp, data); err != nil {
+			return nil, err
+		}
+		result, err := json.Marshal(data)
+		if err != nil {
+			return nil, err
+		}
+		if isSSE {
+			result = append([]byte("data: "), result...)
+		}
+		return append(result, '\n'), nil
+	}
+}
+
+// SetDefaults sets the fields missing in the request
+func SetDefaults(defaults map[string]any) RequestTransform {
+	return JSONRequest(func(c echo.Context, data map[string]any) error {
+		for k, v := range defaults {
+			if _, ok := data[k]; !ok {
+				data[k] = v
+			}
+		}
+		return nil
+	})
+}
+
+// Inject sets the fields overriding the client values
+func Inject(values map[string]any) RequestTransform {
+	return JSONRequest(func(c echo.Context, data map[string]any) error {
+		for k, v := range values {
+			data[k] = v
+		}
+		return nil
+	})
+}
+
+// StripFields removes the forbidden fields from the request
+func StripFields(fields ...string) RequestTransform {
+	return JSONRequest(func(c echo.Context, data map[string]any) error {
+		for _, f := range fields {
+			delete(data, f)
+		}
+		return nil
+	})
+}
+
+// NumberField returns the numeric field value, ok is false if it's missing or not a number
+func NumberField(data map[string]any, field string) (float64, bool) {
+	switch v := data[field].(type) {
+	case json.Number:
+		f, err := v.Float64()
+		return f, err == nil
+	case float64:
+		return v, true
+	case int:
+		return float64(v), true
+	}
+	return 0, false
+}
+
+// CapNumber clamps the numeric field to the limit returned for the request, the missing field is set to the limit
+// if setMissing is true, limit <= 0 means no cap
+func CapNumber(field string, setMissing bool, limit func(c echo.Context) float64) RequestTransform {
+	return JSONRequest(func(c echo.Context, data map[string]any) error {
+		l := limit(c)
+		if l <= 0 {
+			return nil
+		}
+		v, ok := NumberField(data, field)
+		if (!ok && setMissing) || (ok && v > l) {
+			data[field] = l
+		}
+		return nil
+	})
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"math"
+	"strings"
+
+	"github.com/labstack/echo/v4"
+	"github.com/rkfg/authproxy/proxy"
+)
+
+type SDLimit struct {
+	MaxPixels    int  `yaml:"max_pixels" description:"Maximum width×height of the result including hires fix upscale"`
+	MaxSteps     int  `yaml:"max_steps" description:"Maximum sampling steps"`
+	MaxBatchSize int  `yaml:"max_batch_size" description:"Maximum batch size"`
+	MaxNIter     int  `yaml:"max_n_iter" description:"Maximum batch count"`
+	Reject       bool `yaml:"reject" description:"Reject the requests exceeding the limits instead of clamping"`
+}
+
+// sdLimitFor looks up the limits by user login, then by the user's ACL roles (@role entries) in order and finally
+// the "default" entry
+func sdLimitFor(user string) (SDLimit, bool) {
+	if user != "" {
+		if l, ok := config.SDLimits[user]; ok {
+			return l, true
+		}
+		for _, entry := range config.ACL[user] {
+			if role, ok := strings.CutPrefix(entry, "@"); ok {
+				if l, ok := config.SDLimits[role]; ok {
+					return l, true
+				}
+			}
+		}
+	}
+	l, ok := config.SDLimits["default"]
+	return l, ok
+}
+
+// sdNumber returns the numeric field or the default if it's missing, the SD API coerces strings to numbers so other
+// values are rejected instead of bypassing the limits
+func sdNumber(data map[string]any, field string, def float64) (float64, error) {
+	if v, ok := data[field]; !ok || v == nil {
+		return def, nil
+	}
+	if v, ok := proxy.NumberField(data, field); ok {
+		return v, nil
+	}
+	return 0, echo.NewHTTPError(400, fmt.Sprintf("Invalid %s: must be a number", field))
+}
+
+// hiresSize returns the hires fix target resolution computed the same way as in A1111, the missing side of the
+// resize follows the aspect ratio of the first pass
+func hiresSize(data map[string]any, w, h float64) (float64, float64, error) {
+	rx, err := sdNumber(data, "hr_resize_x", 0)
+	if err != nil {
+		return 0, 0, err
+	}
+	ry, err := sdNumber(data, "hr_resize_y", 0)
+	if err != nil {
+		return 0, 0, err
+	}
+	switch {
+	case rx <= 0 && ry <= 0:
+		scale, err := sdNumber(data, "hr_scale", 2)
+		if err != nil {
+			return 0, 0, err
+		}
+		return w * scale, h * scale, nil
+	case ry <= 0:
+		return rx, math.Floor(rx * h / w), nil
+	case rx <= 0:
+		return math.Floor(ry * w / h), ry, nil
+	}
+	return rx, ry, nil
+}
+
+// enforceSDLimits clamps or rejects txt2img/img2img payloads exceeding the user limits
+func enforceSDLimits(c echo.Context, data map[string]any) error {
+	user := optionalUser(c)
+	limit, ok := sdLimitFor(user)
+	if !ok {
+		return nil
+	}
+	var violations []string
+	clamp := func(field string, max int, def float64) error {
+		if max <= 0 {
+			return nil
+		}
+		v, err := sdNumber(data, field, def)
+		if err != nil {
+			return err
+		}
+		if v > float64(max) {
+			violations = append(violations, fmt.Sprintf("%s %g > %d", field, v, max))
+			data[field] = max
+		}
+		return nil
+	}
+	for _, f := range []struct {
+		field string
+		max   int
+		def   float64
+	}{
+		{"steps", limit.MaxSteps, 50},
+		{"hr_second_pass_steps", limit.MaxSteps, 0},
+		{"batch_size", limit.MaxBatchSize, 1},
+		{"n_iter", limit.MaxNIter, 1},
+	} {
+		if err := clamp(f.field, f.max, f.def); err != nil {
+			return err
+		}
+	}
+	if limit.MaxPixels > 0 {
+		w, err := sdNumber(data, "width", 512)
+		if err != nil {
+			return err
+		}
+		h, err := sdNumber(data, "height", 512)
+		if err != nil {
+			return err
+		}
+		if w <= 0 || h <= 0 {
+			return echo.NewHTTPError(400, "Invalid resolution")
+		}
+		fw, fh := w, h
+		hr := false
+		if v, ok := data["enable_hr"]; ok && v != nil {
+			if hr, ok = v.(bool); !ok {
+				return echo.NewHTTPError(400, "Invalid enable_hr: must be a boolean")
+			}
+		}
+		if hr {
+			if fw, fh, err = hiresSize(data, w, h); err != nil {
+				return err
+			}
+		}
+		if fw*fh > float64(limit.MaxPixels) {
+			violations = append(violations, fmt.Sprintf("resolution %gx%g > %d pixels", fw, fh, limit.MaxPixels))
+			factor := math.Sqrt(float64(limit.MaxPixels) / (fw * fh))
+			round8 := func(v float64) int {
+				return max(8, int(v*factor)/8*8)
+			}
+			data["width"] = round8(w)
+			data["height"] = round8(h)
+			if hr {
+				// the missing side stays 0 to keep following the aspect ratio
+				for _, field := range []string{"hr_resize_x", "hr_resize_y"} {
+					if v, _ := sdNumber(data, field, 0); v > 0 {
+						data[field] = round8(v)
+					}
+				}
+			}
+		}
+	}
+	if len(violations) == 0 {
+		return nil
+	}
+	if limit.Reject {
+		return echo.NewHTTPError(400, "Generation limits exceeded: "+strings.Join(violations, ", "))
+	}
+	log.Printf("Clamped SD request of user %s: %s", user, strings.Join(violations, ", "))
+	return nil
+}
+
+func sdRules() []proxy.Rule {
+	return []proxy.Rule{{
+		Method:  "POST",
+		Path:    proxy.MatchPaths("/sdapi/v1/txt2img", "/sdapi/v1/img2img"),
+		Request: []proxy.RequestTransform{proxy.JSONRequest(enforceSDLimits)},
+	}}
+}
@@ -11,7 +11,7 @@ import (
 )
 
 func newTTSProxy(ttsurl *url.URL, sq *servicequeue.ServiceQueue, wd *watchdog.Watchdog) echo.MiddlewareFunc {
-	return proxy.NewProxyWrapper(ttsurl, &proxy.Interceptor{
+	return proxy.NewProxyWrapper(ttsurl, backendInterceptor("tts", &proxy.Interceptor{
 		Before: func(c echo.Context) {
 			path := c.Request().URL.Path
 			if c.Request().Method == "POST" && path == "/api/generate" || path == "/api/rvc" {
@@ -28,5 +28,5 @@ func newTTSProxy(ttsurl *url.URL, sq *servicequeue.ServiceQueue, wd *watchdog.Wa
 		After: sq.ServiceCloser(servicequeue.TTS, func(path string) bool {
 			return path == "/api/generate" || path == "/api/rvc"
 		}, time.Second*5, true)},
-	)
+	))
 }
@@ -0,0 +1,56 @@
+package upload
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/rkfg/authproxy/civitai"
+)
+
+// errExists is returned when the target file exists and replacing it wasn't requested
+var errExists = errors.New("file already exists")
+
+func exists(filename string) bool {
+	_, err := os.Stat(filename)
+	return err == nil
+}
+
+// createTemp creates a temporary file in the staging directory, it's on the same filesystem as the target so the
+// finished file can be moved into place atomically and A1111 never sees it half-written
+func (cat *Category) createTemp() (*os.File, error) {
+	if err := os.MkdirAll(cat.stagingPath(), 0755); err != nil {
+		return nil, err
+	}
+	return os.CreateTemp(cat.stagingPath(), "*.tmp")
+}
+
+// validateModel checks that the file is a well-formed model of the type defined by the target name
+func validateModel(filename string, name string) error {
+	if !strings.EqualFold(filepath.Ext(name), ".safetensors") {
+		return nil
+	}
+	_, err := civitai.ReadSafetensorsFile(filename)
+	return err
+}
+
+// placeFile moves the finished file to the target, the existing file is only overwritten if replace is true
+func placeFile(tmp string, target string, replace bool) error {
+	if err := os.Chmod(tmp, 0644); err != nil {
+		return err
+	}
+	if replace {
+		return os.Rename(tmp, target)
+	}
+	if err := os.Link(tmp, target); err != nil {
+		if os.IsExist(err) {
+			return errExists
+		}
+		if exists(target) { // hard links are not supported, fall back to a non-atomic check
+			return errExists
+		}
+		return os.Rename(tmp, target)
+	}
+	return os.Remove(tmp)
+}
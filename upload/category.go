@@ -0,0 +1,115 @@
+package upload
+
+import (
+	"fmt"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"github.com/labstack/echo/v4"
+)
+
+// Category is a kind of model files stored under its own root
+type Category struct {
+	Name         string      `yaml:"name" json:"name"`
+	Title        string      `yaml:"title" json:"title"`
+	Root         string      `yaml:"root" json:"-"`
+	Extensions   []string    `yaml:"extensions,flow" json:"extensions"`
+	CivitAITypes []string    `yaml:"civitai_types,flow" json:"civitai_types"`
+	MaxSize      int64       `yaml:"max_size" json:"max_size"`
+	Role         string      `yaml:"role" json:"-"`
+	Trash        string      `yaml:"trash" json:"-"` // deleted files directory, <root>.trash if empty
+	Quotas       QuotaConfig `yaml:"quotas" json:"-"`
+	index        *fileIndex
+	search       *searchIndex
+}
+
+// DefaultCategory is used when no categories are configured, it keeps the original LoRA-only behavior
+func DefaultCategory(root string) Category {
+	return Category{
+		Name:         "lora",
+		Title:        "LoRA",
+		Root:         root,
+		Extensions:   []string{".safetensors"},
+		CivitAITypes: []string{"lora", "locon", "dora"},
+		MaxSize:      1024 * 1024 * 1024,
+	}
+}
+
+func (cat *Category) fullPath(dir string) (string, error) {
+	if dir != "" && !filepath.IsLocal(dir) {
+		return "", fmt.Errorf("invalid path")
+	}
+	return filepath.Join(cat.Root, dir), nil
+}
+
+// modelExt returns the allowed extension of the file name or empty string
+func (cat *Category) modelExt(fn string) string {
+	lower := strings.ToLower(fn)
+	for _, ext := range cat.Extensions {
+		if strings.HasSuffix(lower, strings.ToLower(ext)) {
+			return fn[len(fn)-len(ext):]
+		}
+	}
+	return ""
+}
+
+func (cat *Category) validateFilename(fn string) error {
+	if !filepath.IsLocal(fn) {
+		return fmt.Errorf("invalid file name")
+	}
+	if !validateName(fn) {
+		return fmt.Errorf("invalid file name")
+	}
+	if cat.modelExt(fn) == "" {
+		return fmt.Errorf("only %s files are supported", strings.Join(cat.Extensions, ", "))
+	}
+	return nil
+}
+
+func (cat *Category) modelAllowed(modelType string) bool {
+	return slices.Contains(cat.CivitAITypes, strings.ToLower(modelType))
+}
+
+func (cat *Category) tooBig(size int64) bool {
+	return cat.MaxSize > 0 && size > cat.MaxSize
+}
+
+func (u *uploader) allowed(c echo.Context, cat *Category) bool {
+	return cat.Role == "" || u.hasRole == nil || u.hasRole(c, cat.Role)
+}
+
+// category returns the category selected by the "category" parameter, the first one is the default
+func (u *uploader) category(c echo.Context) (*Category, error) {
+	name := c.FormValue("category")
+	for i := range u.categories {
+		cat := &u.categories[i]
+		if name != "" && cat.Name != name {
+			continue
+		}
+		if !u.allowed(c, cat) {
+			return nil, fmt.Errorf("access to %s is denied", cat.Title)
+		}
+		return cat, nil
+	}
+	return nil, fmt.Errorf("unknown category %s", name)
+}
+
+func (u *uploader) categoryByName(name string) *Category {
+	for i := range u.categories {
+		if u.categories[i].Name == name {
+			return &u.categories[i]
+		}
+	}
+	return nil
+}
+
+func (u *uploader) listCategories(c echo.Context) error {
+	result := []Category{}
+	for _, cat := range u.categories {
+		if u.allowed(c, &cat) {
+			result = append(result, cat)
+		}
+	}
+	return JSONOk(c, result)
+}
@@ -0,0 +1,362 @@
+package upload
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/rkfg/authproxy/metrics"
+)
+
+const (
+	stagingDir         = ".uploads"
+	stagingMaxAge      = time.Hour * 24
+	stagingCleanPeriod = time.Hour
+)
+
+var uploadIDRegexp = regexp.MustCompile(`^[0-9a-f]{32}$`)
+
+// chunkedUpload is the state of a resumable upload, the data is appended to <id>.part in the staging directory
+type chunkedUpload struct {
+	Dir      string `json:"dir"`
+	Filename string `json:"filename"`
+	Size     int64  `json:"size"`
+	SHA256   string `json:"sha256,omitempty"`
+	User     string `json:"user,omitempty"`
+	Replace  bool   `json:"replace,omitempty"`
+}
+
+// stagingPath returns the staging directory of the category for the unfinished uploads and downloads, it's inside
+// the category root so that the finished file can be renamed into place atomically
+func (cat *Category) stagingPath() string {
+	return filepath.Join(cat.Root, stagingDir)
+}
+
+func newUploadID() (string, error) {
+	buf := make([]byte, 16)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(buf), nil
+}
+
+func validateSHA256(sum string) bool {
+	b, err := hex.DecodeString(sum)
+	return err == nil && len(b) == sha256.Size
+}
+
+// lockUpload prevents concurrent writes to the same upload, returns false if it's already locked
+func (u *uploader) lockUpload(id string) bool {
+	u.chunksLock.Lock()
+	defer u.chunksLock.Unlock()
+	if _, ok := u.activeChunks[id]; ok {
+		return false
+	}
+	u.activeChunks[id] = struct{}{}
+	return true
+}
+
+func (u *uploader) unlockUpload(id string) {
+	u.chunksLock.Lock()
+	defer u.chunksLock.Unlock()
+	delete(u.activeChunks, id)
+}
+
+// loadUpload returns the upload state and the path to its data file
+func (u *uploader) loadUpload(c echo.Context) (*Category, *chunkedUpload, string, error) {
+	cat, err := u.category(c)
+	if err != nil {
+		return nil, nil, "", echo.NewHTTPError(http.StatusForbidden, err.Error())
+	}
+	id := c.Param("id")
+	if !uploadIDRegexp.MatchString(id) {
+		return nil, nil, "", echo.NewHTTPError(http.StatusBadRequest, "invalid upload id")
+	}
+	base := filepath.Join(cat.stagingPath(), id)
+	f, err := os.Open(base + ".json")
+	if err != nil {
+		return nil, nil, "", echo.NewHTTPError(http.StatusNotFound, "upload not found")
+	}
+	defer f.Close()
+	var result chunkedUpload
+	if err := json.NewDecoder(f).Decode(&result); err != nil {
+		return nil, nil, "", err
+	}
+	return cat, &result, base + ".part", nil
+}
+
+func uploadError(c echo.Context, err error) error {
+	if he, ok := err.(*echo.HTTPError); ok {
+		return JSONErrorMessage(c, he.Code, fmt.Sprint(he.Message))
+	}
+	return JSONError(c, 500, err)
+}
+
+func partSize(filename string) (int64, error) {
+	fi, err := os.Stat(filename)
+	if err != nil {
+		return 0, err
+	}
+	return fi.Size(), nil
+}
+
+// createChunked starts a new resumable upload, the expected SHA-256 can be passed now or with the last chunk
+func (u *uploader) createChunked(c echo.Context) error {
+	cat, err := u.category(c)
+	if err != nil {
+		return JSONError(c, 403, err)
+	}
+	upload := chunkedUpload{Dir: c.FormValue("dir"), Filename: c.FormValue("filename"), SHA256: strings.ToLower(c.FormValue("sha256")), User: u.user(c),
+		Replace: c.FormValue("replace") == "true"}
+	if !validateName(upload.Dir) {
+		return JSONErrorMessage(c, 400, "Invalid directory name")
+	}
+	fullpath, err := cat.fullPath(upload.Dir)
+	if err != nil {
+		return JSONError(c, 400, err)
+	}
+	if err := cat.validateFilename(upload.Filename); err != nil {
+		return JSONError(c, 400, err)
+	}
+	if !upload.Replace && exists(filepath.Join(fullpath, upload.Filename)) {
+		return JSONError(c, 409, errExists)
+	}
+	if !u.canReplace(c, cat, upload.Dir, upload.Filename) {
+		return JSONErrorMessage(c, 403, "access denied")
+	}
+	if upload.Size, err = strconv.ParseInt(c.FormValue("size"), 10, 64); err != nil || upload.Size <= 0 {
+		return JSONErrorMessage(c, 400, "invalid file size")
+	}
+	if cat.tooBig(upload.Size) {
+		return JSONErrorMessage(c, 400, "file too big")
+	}
+	if err := cat.checkQuota(upload.Dir, upload.User, upload.Size, filepath.Join(fullpath, upload.Filename)); err != nil {
+		return JSONError(c, 400, err)
+	}
+	if upload.SHA256 != "" && !validateSHA256(upload.SHA256) {
+		return JSONErrorMessage(c, 400, "invalid SHA-256")
+	}
+	id, err := newUploadID()
+	if err != nil {
+		return JSONError(c, 500, err)
+	}
+	if err := os.MkdirAll(cat.stagingPath(), 0755); err != nil {
+		return JSONError(c, 500, err)
+	}
+	base := filepath.Join(cat.stagingPath(), id)
+	part, err := os.Create(base + ".part")
+	if err != nil {
+		return JSONError(c, 500, err)
+	}
+	part.Close()
+	if err := writeJSON(base+".json", upload); err != nil {
+		os.Remove(base + ".part")
+		return JSONError(c, 500, err)
+	}
+	return JSONOk(c, Result{"id": id, "offset": 0, "size": upload.Size})
+}
+
+// chunkedStatus returns the current offset to resume from, HEAD requests get it in the Upload-Offset header
+func (u *uploader) chunkedStatus(c echo.Context) error {
+	_, upload, part, err := u.loadUpload(c)
+	if err != nil {
+		return uploadError(c, err)
+	}
+	offset, err := partSize(part)
+	if err != nil {
+		return JSONError(c, 500, err)
+	}
+	c.Response().Header().Set("Upload-Offset", strconv.FormatInt(offset, 10))
+	c.Response().Header().Set("Upload-Length", strconv.FormatInt(upload.Size, 10))
+	if c.Request().Method == http.MethodHead {
+		return c.NoContent(http.StatusOK)
+	}
+	return JSONOk(c, Result{"offset": offset, "size": upload.Size, "dir": upload.Dir, "filename": upload.Filename})
+}
+
+// putChunk appends the request body at the offset which must be equal to the received size, the upload is finished
+// when the last byte is written
+func (u *uploader) putChunk(c echo.Context) error {
+	cat, upload, part, err := u.loadUpload(c)
+	if err != nil {
+		return uploadError(c, err)
+	}
+	id := c.Param("id")
+	if !u.lockUpload(id) {
+		return JSONErrorMessage(c, 409, "upload is in progress")
+	}
+	defer u.unlockUpload(id)
+	offset, err := strconv.ParseInt(c.QueryParam("offset"), 10, 64)
+	if err != nil {
+		return JSONErrorMessage(c, 400, "invalid offset")
+	}
+	current, err := partSize(part)
+	if err != nil {
+		return JSONError(c, 500, err)
+	}
+	if offset != current {
+		c.Response().Header().Set("Upload-Offset", strconv.FormatInt(current, 10))
+		return c.JSON(409, Result{"message": "offset mismatch", "offset": current})
+	}
+	f, err := os.OpenFile(part, os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return JSONError(c, 500, err)
+	}
+	n, err := io.Copy(f, io.LimitReader(c.Request().Body, upload.Size-current))
+	f.Close()
+	current += n
+	if err != nil { // keep what was received, the client resumes from the new offset
+		log.Printf("Error receiving chunk of %s: %s", upload.Filename, err)
+		return c.JSON(500, Result{"message": err.Error(), "offset": current})
+	}
+	if current < upload.Size {
+		return JSONOk(c, Result{"offset": current})
+	}
+	if sum := strings.ToLower(c.QueryParam("sha256")); sum != "" {
+		if !validateSHA256(sum) {
+			return JSONErrorMessage(c, 400, "invalid SHA-256")
+		}
+		upload.SHA256 = sum
+	}
+	if upload.SHA256 == "" {
+		return JSONErrorMessage(c, 400, "SHA-256 is required to finish the upload")
+	}
+	return u.finishChunked(c, cat, upload, part)
+}
+
+func fileSHA256(filename string) (string, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// finishChunked verifies the checksum and moves the file into place
+func (u *uploader) finishChunked(c echo.Context, cat *Category, upload *chunkedUpload, part string) error {
+	sum, err := fileSHA256(part)
+	if err != nil {
+		return JSONError(c, 500, err)
+	}
+	base := strings.TrimSuffix(part, ".part")
+	if sum != upload.SHA256 {
+		os.Remove(part)
+		os.Remove(base + ".json")
+		return JSONErrorMessage(c, 422, fmt.Sprintf("checksum mismatch: expected %s, got %s", upload.SHA256, sum))
+	}
+	fullpath, err := cat.fullPath(upload.Dir)
+	if err != nil {
+		return JSONError(c, 400, err)
+	}
+	if err := os.MkdirAll(fullpath, 0755); err != nil {
+		return JSONError(c, 500, err)
+	}
+	target := filepath.Join(fullpath, upload.Filename)
+	if err := validateModel(part, upload.Filename); err != nil {
+		os.Remove(part)
+		os.Remove(base + ".json")
+		return JSONError(c, 422, err)
+	}
+	// the file could appear after the upload was created
+	if !u.canReplace(c, cat, upload.Dir, upload.Filename) {
+		return JSONErrorMessage(c, 403, "access denied")
+	}
+	owner := cat.ownerAfterWrite(target, upload.User)
+	if err := placeFile(part, target, upload.Replace); err == errExists {
+		return JSONError(c, 409, err)
+	} else if err != nil {
+		return JSONError(c, 500, err)
+	}
+	os.Remove(base + ".json")
+	cat.recordFile(target, fileInfo{Owner: owner, Source: "upload", SHA256: sum})
+	u.m <- metrics.MetricUpdate{Type: metrics.UPLOAD_COUNT, Value: 1}
+	u.m <- metrics.MetricUpdate{Type: metrics.UPLOAD_SIZE, Value: float64(upload.Size)}
+	go func() {
+		err := u.civitdl.UpdateFile(target)
+		if err != nil {
+			log.Printf("Error getting metadata from CivitAI: %s", err)
+		}
+	}()
+	return JSONOk(c, Result{"offset": upload.Size, "complete": true})
+}
+
+func (u *uploader) deleteChunked(c echo.Context) error {
+	_, _, part, err := u.loadUpload(c)
+	if err != nil {
+		return uploadError(c, err)
+	}
+	id := c.Param("id")
+	if !u.lockUpload(id) {
+		return JSONErrorMessage(c, 409, "upload is in progress")
+	}
+	defer u.unlockUpload(id)
+	os.Remove(part)
+	os.Remove(strings.TrimSuffix(part, ".part") + ".json")
+	return c.NoContent(http.StatusNoContent)
+}
+
+// stagingCleaner removes the uploads abandoned for longer than stagingMaxAge
+func (u *uploader) stagingCleaner() {
+	for {
+		for _, cat := range u.categories {
+			entries, err := os.ReadDir(cat.stagingPath())
+			if err != nil {
+				continue
+			}
+			for _, e := range entries {
+				if strings.HasSuffix(e.Name(), ".tmp") { // interrupted direct uploads and downloads
+					if info, err := e.Info(); err == nil && time.Since(info.ModTime()) > stagingMaxAge {
+						os.Remove(filepath.Join(cat.stagingPath(), e.Name()))
+					}
+					continue
+				}
+				id, ok := strings.CutSuffix(e.Name(), ".json")
+				if !ok || !uploadIDRegexp.MatchString(id) {
+					continue
+				}
+				base := filepath.Join(cat.stagingPath(), id)
+				info, err := os.Stat(base + ".part")
+				if err != nil {
+					info, err = e.Info()
+				}
+				if err != nil || time.Since(info.ModTime()) < stagingMaxAge || !u.lockUpload(id) {
+					continue
+				}
+				log.Printf("Removing stale upload %s of %s", id, cat.Name)
+				os.Remove(base + ".part")
+				os.Remove(base + ".json")
+				u.unlockUpload(id)
+			}
+		}
+		time.Sleep(stagingCleanPeriod)
+	}
+}
+
+func writeJSON(filename string, v any) error {
+	f, err := os.Create(filename)
+	if err != nil {
+		return err
+	}
+	if err := json.NewEncoder(f).Encode(v); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
@@ -0,0 +1,297 @@
+package upload
+
+import (
+	"fmt"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/dustin/go-humanize"
+	"github.com/labstack/echo/v4"
+	"github.com/rkfg/authproxy/civitai"
+)
+
+const defaultLargest = 20
+
+// QuotaConfig limits the space used in the category, the sizes are in bytes and 0 means no limit
+type QuotaConfig struct {
+	Dirs  map[string]int64 `yaml:"dirs"`  // directory relative to the root ("" for the whole category) to its limit, subdirectories included
+	User  int64            `yaml:"user"`  // default limit of the models added by each user
+	Users map[string]int64 `yaml:"users"` // per-user limits overriding the default
+}
+
+type dirUsage struct {
+	Path  string `json:"path"`
+	Size  int64  `json:"size"` // including the subdirectories
+	Files int    `json:"files"`
+	Quota int64  `json:"quota,omitempty"`
+}
+
+type fileUsage struct {
+	Path  string `json:"path"`
+	Size  int64  `json:"size"`
+	Owner string `json:"owner,omitempty"`
+}
+
+type duplicateGroup struct {
+	SHA256 string   `json:"sha256"`
+	Size   int64    `json:"size"`
+	Paths  []string `json:"paths"`
+}
+
+type userUsage struct {
+	User  string `json:"user"`
+	Size  int64  `json:"size"`
+	Files int    `json:"files"`
+	Quota int64  `json:"quota,omitempty"`
+}
+
+type diskReport struct {
+	Free       uint64           `json:"free"`
+	Total      uint64           `json:"total"`
+	Used       int64            `json:"used"` // all files in the category except the trash and the unfinished uploads
+	Trash      int64            `json:"trash"`
+	Unhashed   int              `json:"unhashed"` // models without a cached hash, they aren't checked for duplicates
+	Dirs       []dirUsage       `json:"dirs"`
+	Largest    []fileUsage      `json:"largest"`
+	Duplicates []duplicateGroup `json:"duplicates"`
+	Users      []userUsage      `json:"users"`
+}
+
+// quotaDir normalizes the directory to the form used in the quota config, the root is an empty string
+func quotaDir(dir string) string {
+	return strings.Trim(path.Clean("/"+filepath.ToSlash(dir)), "/")
+}
+
+func (q *QuotaConfig) userLimit(user string) int64 {
+	if limit, ok := q.Users[user]; ok {
+		return limit
+	}
+	return q.User
+}
+
+func (q *QuotaConfig) dirLimit(dir string) int64 {
+	for d, limit := range q.Dirs {
+		if quotaDir(d) == dir {
+			return limit
+		}
+	}
+	return 0
+}
+
+// treeSize returns the size of all files under the directory, the hidden service directories are skipped
+func treeSize(root string) int64 {
+	var result int64
+	filepath.WalkDir(root, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return nil
+		}
+		if d.IsDir() {
+			if p != root && strings.HasPrefix(d.Name(), ".") {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if fi, err := d.Info(); err == nil {
+			result += fi.Size()
+		}
+		return nil
+	})
+	return result
+}
+
+// userUsage returns the total size of the models added by the user, the companion files aren't counted
+func (cat *Category) userUsage(user string) int64 {
+	var result int64
+	for p, info := range cat.index.snapshot() {
+		if info.Owner != user {
+			continue
+		}
+		if fi, err := os.Stat(filepath.Join(cat.Root, filepath.FromSlash(p))); err == nil {
+			result += fi.Size()
+		}
+	}
+	return result
+}
+
+// quotaLeft returns the space left for a new file added by the user to the directory and the tightest quota name,
+// the space is -1 if there are no limits, the file being replaced counts as free space
+func (cat *Category) quotaLeft(dir string, user string, target string) (int64, string) {
+	left, name := int64(-1), ""
+	limit := func(quota int64, used int64, what string) {
+		if rest := max(quota-used, 0); left < 0 || rest < left {
+			left, name = rest, what
+		}
+	}
+	var replaced int64
+	replacedOwner := ""
+	if fi, err := os.Stat(target); err == nil {
+		replaced = fi.Size()
+		if info := cat.index.get(cat.indexPath(target)); info != nil {
+			replacedOwner = info.Owner
+		}
+	}
+	dir = quotaDir(dir)
+	for d, quota := range cat.Quotas.Dirs {
+		d = quotaDir(d)
+		if quota <= 0 || (d != "" && dir != d && !strings.HasPrefix(dir, d+"/")) {
+			continue
+		}
+		limit(quota, treeSize(filepath.Join(cat.Root, filepath.FromSlash(d)))-replaced, "directory /"+d)
+	}
+	if quota := cat.Quotas.userLimit(user); user != "" && quota > 0 {
+		used := cat.userUsage(user)
+		if replacedOwner == user {
+			used -= replaced
+		}
+		limit(quota, used, "user "+user)
+	}
+	return left, name
+}
+
+func quotaError(name string, left int64) error {
+	return fmt.Errorf("quota of %s exceeded, %s left", name, humanize.IBytes(uint64(left)))
+}
+
+// checkQuota is done before writing the file, so the parallel uploads can exceed the quota together
+func (cat *Category) checkQuota(dir string, user string, size int64, target string) error {
+	if left, name := cat.quotaLeft(dir, user, target); left >= 0 && size > left {
+		return quotaError(name, left)
+	}
+	return nil
+}
+
+// diskReport collects the directory sizes, the largest models, the duplicates and the space used by each user
+func (cat *Category) diskReport(largest int) *diskReport {
+	result := diskReport{Dirs: []dirUsage{}, Largest: []fileUsage{}, Duplicates: []duplicateGroup{}, Users: []userUsage{}}
+	index := cat.index.snapshot()
+	dirs := map[string]*dirUsage{"": {}}
+	hashes := map[string]*duplicateGroup{}
+	users := map[string]*userUsage{}
+	filepath.WalkDir(cat.Root, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return nil
+		}
+		rel := cat.indexPath(p)
+		if d.IsDir() {
+			if p == cat.Root {
+				return nil
+			}
+			if strings.HasPrefix(d.Name(), ".") {
+				return filepath.SkipDir
+			}
+			if !strings.HasSuffix(d.Name(), civitai.GallerySuffix) {
+				dirs[rel] = &dirUsage{}
+			}
+			return nil
+		}
+		fi, err := d.Info()
+		if err != nil {
+			return nil
+		}
+		result.Used += fi.Size()
+		for dir := path.Dir(rel); ; dir = path.Dir(dir) {
+			if dir == "." {
+				dir = ""
+			}
+			if du, ok := dirs[dir]; ok {
+				du.Size += fi.Size()
+				du.Files++
+			}
+			if dir == "" {
+				break
+			}
+		}
+		if cat.modelExt(d.Name()) == "" {
+			return nil
+		}
+		info := index[rel]
+		result.Largest = append(result.Largest, fileUsage{Path: rel, Size: fi.Size(), Owner: info.Owner})
+		if info.Owner != "" {
+			if users[info.Owner] == nil {
+				users[info.Owner] = &userUsage{User: info.Owner}
+			}
+			users[info.Owner].Size += fi.Size()
+			users[info.Owner].Files++
+		}
+		sum := info.SHA256
+		if sum == "" {
+			sum = civitai.LookupSHA256(p, fi)
+		}
+		if sum == "" {
+			result.Unhashed++
+			return nil
+		}
+		if hashes[sum] == nil {
+			hashes[sum] = &duplicateGroup{SHA256: sum, Size: fi.Size()}
+		}
+		hashes[sum].Paths = append(hashes[sum].Paths, rel)
+		return nil
+	})
+	result.Trash = treeSize(cat.trashPath())
+	for p, du := range dirs {
+		du.Path = p
+		du.Quota = cat.Quotas.dirLimit(p)
+		result.Dirs = append(result.Dirs, *du)
+	}
+	sort.Slice(result.Dirs, func(i, j int) bool { return result.Dirs[i].Path < result.Dirs[j].Path })
+	sort.Slice(result.Largest, func(i, j int) bool { return result.Largest[i].Size > result.Largest[j].Size })
+	result.Largest = result.Largest[:min(len(result.Largest), largest)]
+	for _, g := range hashes {
+		if len(g.Paths) > 1 {
+			sort.Strings(g.Paths)
+			result.Duplicates = append(result.Duplicates, *g)
+		}
+	}
+	// the groups wasting the most space come first
+	sort.Slice(result.Duplicates, func(i, j int) bool {
+		return result.Duplicates[i].Size*int64(len(result.Duplicates[i].Paths)-1) >
+			result.Duplicates[j].Size*int64(len(result.Duplicates[j].Paths)-1)
+	})
+	for user := range cat.Quotas.Users {
+		if users[user] == nil {
+			users[user] = &userUsage{User: user}
+		}
+	}
+	for _, uu := range users {
+		uu.Quota = cat.Quotas.userLimit(uu.User)
+		result.Users = append(result.Users, *uu)
+	}
+	sort.Slice(result.Users, func(i, j int) bool { return result.Users[i].Size > result.Users[j].Size })
+	return &result
+}
+
+func (u *uploader) stat(c echo.Context) error {
+	cat, err := u.category(c)
+	if err != nil {
+		return JSONError(c, 403, err)
+	}
+	free, _, err := diskSpace(cat.Root)
+	if err != nil {
+		return JSONError(c, 500, err)
+	}
+	return JSONOk(c, Result{"free": humanize.IBytes(free)})
+}
+
+// disk returns the disk usage report, the "largest" parameter sets the number of the largest models
+func (u *uploader) disk(c echo.Context) error {
+	cat, err := u.category(c)
+	if err != nil {
+		return JSONError(c, 403, err)
+	}
+	largest := defaultLargest
+	if n, err := strconv.Atoi(c.QueryParam("largest")); err == nil && n > 0 {
+		largest = min(n, maxPerPage)
+	}
+	free, total, err := diskSpace(cat.Root)
+	if err != nil {
+		return JSONError(c, 500, err)
+	}
+	result := cat.diskReport(largest)
+	result.Free, result.Total = free, total
+	return JSONOk(c, result)
+}
@@ -1,15 +1,14 @@
 package upload
 
 import (
-	"github.com/dustin/go-humanize"
-	"github.com/labstack/echo/v4"
 	"golang.org/x/sys/unix"
 )
 
-func (u *uploader) stat(c echo.Context) error {
+// diskSpace returns the space available to the user and the total size of the filesystem
+func diskSpace(path string) (free uint64, total uint64, err error) {
 	var stat unix.Statfs_t
-	if err := unix.Statfs(u.root, &stat); err != nil {
-		return JSONError(c, 500, err)
+	if err := unix.Statfs(path, &stat); err != nil {
+		return 0, 0, err
 	}
-	return JSONOk(c, Result{"free": humanize.IBytes(stat.Bavail * uint64(stat.Bsize))})
+	return stat.Bavail * uint64(stat.Bsize), stat.Blocks * uint64(stat.Bsize), nil
 }
@@ -1,9 +1,15 @@
 package upload
 
 import (
-	"github.com/labstack/echo/v4"
+	"golang.org/x/sys/windows"
 )
 
-func (u *uploader) stat(c echo.Context) error {
-	return JSONOk(c, Result{"free": "unsupported"})
+// diskSpace returns the space available to the user and the total size of the volume
+func diskSpace(path string) (free uint64, total uint64, err error) {
+	p, err := windows.UTF16PtrFromString(path)
+	if err != nil {
+		return 0, 0, err
+	}
+	err = windows.GetDiskFreeSpaceEx(p, &free, &total, nil)
+	return free, total, err
 }
@@ -0,0 +1,146 @@
+package upload
+
+import (
+	"encoding/json"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rkfg/authproxy/civitai"
+)
+
+// fileInfo records who added the model and where it came from
+type fileInfo struct {
+	Owner     string    `json:"owner,omitempty"`
+	Source    string    `json:"source"` // "upload" or the download source name
+	URL       string    `json:"url,omitempty"`
+	SHA256    string    `json:"sha256,omitempty"`
+	Timestamp time.Time `json:"timestamp"`
+}
+
+// fileIndex maps the model paths relative to the category root to their info, it's stored in the staging directory
+type fileIndex struct {
+	sync.Mutex
+	filename string
+	files    map[string]*fileInfo
+}
+
+func loadFileIndex(filename string) *fileIndex {
+	result := &fileIndex{filename: filename, files: map[string]*fileInfo{}}
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Printf("Error reading file index: %s", err)
+		}
+		return result
+	}
+	if err := json.Unmarshal(data, &result.files); err != nil {
+		log.Printf("Error parsing file index %s: %s", filename, err)
+	}
+	return result
+}
+
+// save writes the index to disk, must be called with the lock held
+func (fi *fileIndex) save() {
+	data, err := json.Marshal(fi.files)
+	if err != nil {
+		log.Printf("Error encoding file index: %s", err)
+		return
+	}
+	tmp := fi.filename + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		log.Printf("Error saving file index: %s", err)
+		return
+	}
+	if err := os.Rename(tmp, fi.filename); err != nil {
+		log.Printf("Error saving file index: %s", err)
+	}
+}
+
+func (fi *fileIndex) get(path string) *fileInfo {
+	fi.Lock()
+	defer fi.Unlock()
+	if info, ok := fi.files[path]; ok {
+		result := *info
+		return &result
+	}
+	return nil
+}
+
+// snapshot returns a copy of all entries
+func (fi *fileIndex) snapshot() map[string]fileInfo {
+	fi.Lock()
+	defer fi.Unlock()
+	result := make(map[string]fileInfo, len(fi.files))
+	for p, info := range fi.files {
+		result[p] = *info
+	}
+	return result
+}
+
+func (fi *fileIndex) set(path string, info fileInfo) {
+	fi.Lock()
+	defer fi.Unlock()
+	fi.files[path] = &info
+	fi.save()
+}
+
+// remove deletes the entry and returns it
+func (fi *fileIndex) remove(path string) *fileInfo {
+	fi.Lock()
+	defer fi.Unlock()
+	info, ok := fi.files[path]
+	if !ok {
+		return nil
+	}
+	delete(fi.files, path)
+	fi.save()
+	return info
+}
+
+// move renames the entry of a file or all entries under a directory
+func (fi *fileIndex) move(from string, to string) {
+	fi.Lock()
+	defer fi.Unlock()
+	changed := false
+	for p, info := range fi.files {
+		if p == from {
+			delete(fi.files, p)
+			fi.files[to] = info
+			changed = true
+		} else if rest, ok := strings.CutPrefix(p, from+"/"); ok {
+			delete(fi.files, p)
+			fi.files[to+"/"+rest] = info
+			changed = true
+		}
+	}
+	if changed {
+		fi.save()
+	}
+}
+
+// indexPath returns the index key of the absolute path
+func (cat *Category) indexPath(fullpath string) string {
+	rel, err := filepath.Rel(cat.Root, fullpath)
+	if err != nil {
+		return fullpath
+	}
+	return filepath.ToSlash(rel)
+}
+
+// recordFile saves the info of a newly added model
+func (cat *Category) recordFile(fullpath string, info fileInfo) {
+	info.Timestamp = time.Now()
+	cat.index.set(cat.indexPath(fullpath), info)
+	if info.SHA256 != "" {
+		if err := civitai.StoreSHA256(fullpath, info.SHA256); err != nil {
+			log.Printf("Error caching hash of %s: %s", fullpath, err)
+		}
+	}
+	if cat.search != nil {
+		cat.search.update(fullpath)
+	}
+}
@@ -0,0 +1,370 @@
+package upload
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/rkfg/authproxy/civitai"
+)
+
+const (
+	legacyTrashDir   = ".trash" // the trash used to be inside the root where the webui and the tools still saw it
+	trashSuffix      = ".trash"
+	trashCleanPeriod = time.Hour
+)
+
+// companionSuffixes are the files that belong to the model and are moved and deleted along with it
+var companionSuffixes = []string{".json", ".preview.png", ".preview.mp4", civitai.HashSuffix, civitai.ThumbnailSuffix,
+	civitai.GallerySuffix}
+
+// trashEntry describes a deleted file or directory, it's stored as info.json in the entry directory next to the
+// deleted files
+type trashEntry struct {
+	ID      string    `json:"id"`
+	Path    string    `json:"path"`
+	Dir     bool      `json:"dir,omitempty"`
+	Files   []string  `json:"files,omitempty"`
+	Deleted time.Time `json:"deleted"`
+	User    string    `json:"user,omitempty"`
+	Info    *fileInfo `json:"info,omitempty"` // the index entry of the deleted model
+}
+
+// trashPath is outside of the root so that the deleted models aren't listed by the webui, it should be on the same
+// filesystem for the models to be moved there
+func (cat *Category) trashPath() string {
+	if cat.Trash != "" {
+		return cat.Trash
+	}
+	return filepath.Clean(cat.Root) + trashSuffix
+}
+
+// migrateTrash moves the entries from the trash inside the root
+func (cat *Category) migrateTrash() {
+	legacy := filepath.Join(cat.Root, legacyTrashDir)
+	entries, err := os.ReadDir(legacy)
+	if err != nil {
+		return
+	}
+	if err := os.MkdirAll(cat.trashPath(), 0755); err != nil {
+		log.Printf("Error creating trash %s: %s", cat.trashPath(), err)
+		return
+	}
+	for _, e := range entries {
+		if err := os.Rename(filepath.Join(legacy, e.Name()), filepath.Join(cat.trashPath(), e.Name())); err != nil {
+			log.Printf("Error moving %s to %s: %s", e.Name(), cat.trashPath(), err)
+		}
+	}
+	if err := os.Remove(legacy); err != nil {
+		log.Printf("Error removing the old trash %s: %s", legacy, err)
+	}
+}
+
+// relPath validates the path of an existing or a new entry, the hidden names are reserved for the service data
+func (cat *Category) relPath(p string) (string, error) {
+	p = strings.Trim(p, "/")
+	if p == "" || !validateName(p) {
+		return "", fmt.Errorf("invalid path %s", p)
+	}
+	for _, part := range strings.Split(p, "/") {
+		if strings.HasPrefix(part, ".") {
+			return "", fmt.Errorf("invalid path %s", p)
+		}
+	}
+	return cat.fullPath(p)
+}
+
+// companions returns the existing companion files of the model
+func companions(filename string, ext string) []string {
+	base := strings.TrimSuffix(filename, ext)
+	var result []string
+	for _, suffix := range companionSuffixes {
+		if exists(base + suffix) {
+			result = append(result, base+suffix)
+		}
+	}
+	return result
+}
+
+func (u *uploader) isAdmin(c echo.Context) bool {
+	return u.hasRole == nil || u.hasRole(c, u.adminRole)
+}
+
+// canModify checks if the user can rename, move and delete the entry, the models can be changed by their owners,
+// the directories and the models without an owner only by admins
+func (u *uploader) canModify(c echo.Context, cat *Category, p string) bool {
+	if u.isAdmin(c) {
+		return true
+	}
+	full, err := cat.relPath(p)
+	if err != nil {
+		return false
+	}
+	return cat.ownedBy(full, u.user(c))
+}
+
+// canReplace checks if the new file can be written to the path, the existing models can only be overwritten by
+// those who can modify them
+func (u *uploader) canReplace(c echo.Context, cat *Category, dir string, filename string) bool {
+	full, err := cat.fullPath(filepath.Join(dir, filename))
+	return err == nil && (!exists(full) || u.canModify(c, cat, filepath.ToSlash(filepath.Join(dir, filename))))
+}
+
+func (cat *Category) ownedBy(fullpath string, user string) bool {
+	info := cat.index.get(cat.indexPath(fullpath))
+	return user != "" && info != nil && info.Owner == user
+}
+
+// ownerAfterWrite returns the owner of the model written to the path, replacing an existing model keeps its owner
+func (cat *Category) ownerAfterWrite(fullpath string, user string) string {
+	if info := cat.index.get(cat.indexPath(fullpath)); info != nil && info.Owner != "" && exists(fullpath) {
+		return info.Owner
+	}
+	return user
+}
+
+// moveEntry renames or moves a directory or a model file with its companions
+func (cat *Category) moveEntry(from string, to string) error {
+	src, err := cat.relPath(from)
+	if err != nil {
+		return err
+	}
+	dst, err := cat.relPath(to)
+	if err != nil {
+		return err
+	}
+	fi, err := os.Stat(src)
+	if err != nil {
+		return err
+	}
+	if exists(dst) {
+		return errExists
+	}
+	if !exists(filepath.Dir(dst)) {
+		return fmt.Errorf("directory %s doesn't exist", filepath.Dir(to))
+	}
+	if fi.IsDir() {
+		if err := os.Rename(src, dst); err != nil {
+			return err
+		}
+		cat.index.move(cat.indexPath(src), cat.indexPath(dst))
+		return nil
+	}
+	ext := cat.modelExt(src)
+	if ext == "" {
+		return fmt.Errorf("%s is not a model file", from)
+	}
+	if err := cat.validateFilename(filepath.Base(dst)); err != nil {
+		return err
+	}
+	if !strings.EqualFold(cat.modelExt(dst), ext) {
+		return fmt.Errorf("the extension can't be changed")
+	}
+	cmp := companions(src, ext)
+	if err := os.Rename(src, dst); err != nil {
+		return err
+	}
+	cat.index.move(cat.indexPath(src), cat.indexPath(dst))
+	dstBase := strings.TrimSuffix(dst, cat.modelExt(dst))
+	for _, f := range cmp {
+		target := dstBase + strings.TrimPrefix(f, strings.TrimSuffix(src, ext))
+		if exists(target) {
+			log.Printf("Companion %s already exists, keeping %s", target, f)
+			continue
+		}
+		if err := os.Rename(f, target); err != nil {
+			log.Printf("Error moving %s to %s: %s", f, target, err)
+		}
+	}
+	return nil
+}
+
+// deleteEntry moves a model file with its companions or an empty directory to the trash
+func (cat *Category) deleteEntry(p string, user string) (*trashEntry, error) {
+	src, err := cat.relPath(p)
+	if err != nil {
+		return nil, err
+	}
+	fi, err := os.Stat(src)
+	if err != nil {
+		return nil, err
+	}
+	id, err := newUploadID()
+	if err != nil {
+		return nil, err
+	}
+	entry := &trashEntry{ID: id, Path: strings.Trim(p, "/"), Dir: fi.IsDir(), Deleted: time.Now(), User: user}
+	entryDir := filepath.Join(cat.trashPath(), id)
+	if !fi.IsDir() && cat.modelExt(src) == "" {
+		return nil, fmt.Errorf("%s is not a model file", p)
+	}
+	if err := os.MkdirAll(entryDir, 0755); err != nil {
+		return nil, err
+	}
+	if fi.IsDir() {
+		if err := os.Remove(src); err != nil {
+			os.RemoveAll(entryDir)
+			return nil, fmt.Errorf("only empty directories can be deleted")
+		}
+	} else {
+		for _, f := range append([]string{src}, companions(src, cat.modelExt(src))...) {
+			if err := os.Rename(f, filepath.Join(entryDir, filepath.Base(f))); err != nil {
+				log.Printf("Error moving %s to trash: %s", f, err)
+				continue
+			}
+			entry.Files = append(entry.Files, filepath.Base(f))
+		}
+		if len(entry.Files) == 0 {
+			os.RemoveAll(entryDir)
+			return nil, fmt.Errorf("error deleting %s", p)
+		}
+		entry.Info = cat.index.remove(cat.indexPath(src))
+	}
+	if err := writeJSON(filepath.Join(entryDir, "info.json"), entry); err != nil {
+		return nil, err
+	}
+	return entry, nil
+}
+
+func (cat *Category) trashEntry(id string) (*trashEntry, error) {
+	if !uploadIDRegexp.MatchString(id) {
+		return nil, fmt.Errorf("invalid id")
+	}
+	data, err := os.ReadFile(filepath.Join(cat.trashPath(), id, "info.json"))
+	if err != nil {
+		return nil, err
+	}
+	var result trashEntry
+	if err := json.Unmarshal(data, &result); err != nil {
+		return nil, err
+	}
+	return &result, nil
+}
+
+// restoreEntry moves the deleted files back to their original location
+func (cat *Category) restoreEntry(id string) error {
+	entry, err := cat.trashEntry(id)
+	if err != nil {
+		return err
+	}
+	full, err := cat.relPath(entry.Path)
+	if err != nil {
+		return err
+	}
+	if exists(full) {
+		return errExists
+	}
+	if entry.Dir {
+		if err := os.MkdirAll(full, 0755); err != nil {
+			return err
+		}
+	} else {
+		dir := filepath.Dir(full)
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return err
+		}
+		entryDir := filepath.Join(cat.trashPath(), id)
+		for _, f := range entry.Files {
+			target := filepath.Join(dir, f)
+			if exists(target) {
+				log.Printf("File %s already exists, keeping it in trash", target)
+				continue
+			}
+			if err := os.Rename(filepath.Join(entryDir, f), target); err != nil {
+				return err
+			}
+		}
+		if entry.Info != nil {
+			cat.index.set(cat.indexPath(full), *entry.Info)
+		}
+	}
+	return os.RemoveAll(filepath.Join(cat.trashPath(), id))
+}
+
+// canRestore checks if the user can restore or purge the deleted entry
+func (u *uploader) canRestore(c echo.Context, cat *Category, id string) bool {
+	if u.isAdmin(c) {
+		return true
+	}
+	entry, err := cat.trashEntry(id)
+	user := u.user(c)
+	return err == nil && user != "" && entry.User == user
+}
+
+func (cat *Category) listTrash() []trashEntry {
+	result := []trashEntry{}
+	entries, err := os.ReadDir(cat.trashPath())
+	if err != nil {
+		return result
+	}
+	for _, e := range entries {
+		if te, err := cat.trashEntry(e.Name()); err == nil {
+			result = append(result, *te)
+		}
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].Deleted.After(result[j].Deleted) })
+	return result
+}
+
+func (u *uploader) listTrash(c echo.Context) error {
+	cat, err := u.category(c)
+	if err != nil {
+		return JSONError(c, 403, err)
+	}
+	return JSONOk(c, cat.listTrash())
+}
+
+func (u *uploader) restoreTrash(c echo.Context) error {
+	cat, err := u.category(c)
+	if err != nil {
+		return JSONError(c, 403, err)
+	}
+	if !u.canRestore(c, cat, c.Param("id")) {
+		return JSONErrorMessage(c, 403, "access denied")
+	}
+	if err := cat.restoreEntry(c.Param("id")); err == errExists {
+		return JSONError(c, 409, err)
+	} else if err != nil {
+		return JSONError(c, 400, err)
+	}
+	return JSONOk(c, Result{})
+}
+
+func (u *uploader) purgeTrash(c echo.Context) error {
+	cat, err := u.category(c)
+	if err != nil {
+		return JSONError(c, 403, err)
+	}
+	id := c.Param("id")
+	if !u.canRestore(c, cat, id) {
+		return JSONErrorMessage(c, 403, "access denied")
+	}
+	if _, err := cat.trashEntry(id); err != nil {
+		return JSONError(c, 404, err)
+	}
+	if err := os.RemoveAll(filepath.Join(cat.trashPath(), id)); err != nil {
+		return JSONError(c, 500, err)
+	}
+	return c.NoContent(204)
+}
+
+// trashCleaner permanently removes the entries deleted earlier than the retention period
+func (u *uploader) trashCleaner() {
+	for {
+		for _, cat := range u.categories {
+			for _, e := range cat.listTrash() {
+				if time.Since(e.Deleted) > u.trashRetention {
+					log.Printf("Removing %s of %s from trash", e.Path, cat.Name)
+					os.RemoveAll(filepath.Join(cat.trashPath(), e.ID))
+				}
+			}
+		}
+		time.Sleep(trashCleanPeriod)
+	}
+}
@@ -0,0 +1,339 @@
+package upload
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/rkfg/authproxy/events"
+)
+
+type jobState string
+
+const (
+	jobQueued   jobState = "queued"
+	jobRunning  jobState = "running"
+	jobDone     jobState = "done"
+	jobFailed   jobState = "failed"
+	jobCanceled jobState = "canceled"
+)
+
+// maxFinishedJobs limits the history kept in the queue
+const maxFinishedJobs = 50
+
+// downloadJob is a remote download, its progress is sent as DOWNLOAD_UPDATE packet data on every change
+type downloadJob struct {
+	ID             string    `json:"id"`
+	Link           string    `json:"link"`
+	URL            string    `json:"url,omitempty"` // the URL submitted by the user
+	Source         string    `json:"source"`
+	Dir            string    `json:"dir"`
+	Category       string    `json:"category"`
+	SHA256         string    `json:"sha256,omitempty"` // expected hash reported by CivitAI
+	Replace        bool      `json:"replace,omitempty"`
+	User           string    `json:"user,omitempty"`
+	Admin          bool      `json:"admin,omitempty"` // the user can replace the models of others
+	Filename       string    `json:"filename,omitempty"`
+	State          jobState  `json:"state"`
+	Error          string    `json:"error,omitempty"`
+	TotalBytes     int64     `json:"total_bytes"`
+	CompletedBytes int64     `json:"completed_bytes"`
+	Created        time.Time `json:"created"`
+	cancel         context.CancelFunc
+}
+
+func (j *downloadJob) finished() bool {
+	return j.State != jobQueued && j.State != jobRunning
+}
+
+// downloadQueue keeps the jobs in the order they were added and persists them so that the queued and interrupted
+// downloads are resumed when the service restarts
+type downloadQueue struct {
+	sync.Mutex
+	cond     *sync.Cond
+	jobs     []*downloadJob
+	filename string
+}
+
+func newDownloadQueue(filename string) *downloadQueue {
+	result := &downloadQueue{filename: filename}
+	result.cond = sync.NewCond(result)
+	if filename == "" {
+		return result
+	}
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Printf("Error reading download queue: %s", err)
+		}
+		return result
+	}
+	if err := json.Unmarshal(data, &result.jobs); err != nil {
+		log.Printf("Error parsing download queue: %s", err)
+	}
+	for _, j := range result.jobs {
+		if j.Source == "" { // added before the sources were introduced
+			j.Source = "civitai"
+		}
+		if j.State == jobRunning {
+			j.State = jobQueued
+			j.CompletedBytes = 0
+		}
+	}
+	return result
+}
+
+// save writes the queue to disk, must be called with the lock held
+func (q *downloadQueue) save() {
+	finished := 0
+	for i := len(q.jobs) - 1; i >= 0; i-- {
+		if q.jobs[i].finished() {
+			finished++
+			if finished > maxFinishedJobs {
+				q.jobs = slices.Delete(q.jobs, i, i+1)
+			}
+		}
+	}
+	if q.filename == "" {
+		return
+	}
+	data, err := json.Marshal(q.jobs)
+	if err != nil {
+		log.Printf("Error encoding download queue: %s", err)
+		return
+	}
+	tmp := q.filename + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		log.Printf("Error saving download queue: %s", err)
+		return
+	}
+	if err := os.Rename(tmp, q.filename); err != nil {
+		log.Printf("Error saving download queue: %s", err)
+	}
+}
+
+func (q *downloadQueue) add(job *downloadJob) downloadJob {
+	q.Lock()
+	defer q.Unlock()
+	q.jobs = append(q.jobs, job)
+	q.save()
+	q.cond.Broadcast()
+	return *job
+}
+
+// next waits for a queued job and marks it as running
+func (q *downloadQueue) next() (*downloadJob, context.Context) {
+	q.Lock()
+	defer q.Unlock()
+	for {
+		for _, j := range q.jobs {
+			if j.State == jobQueued {
+				ctx, cancel := context.WithCancel(context.Background())
+				j.State = jobRunning
+				j.Error = ""
+				j.CompletedBytes = 0
+				j.cancel = cancel
+				q.save()
+				return j, ctx
+			}
+		}
+		q.cond.Wait()
+	}
+}
+
+// update changes the job under the lock and returns its copy, the queue is saved if persist is true
+func (q *downloadQueue) update(job *downloadJob, persist bool, f func(j *downloadJob)) downloadJob {
+	q.Lock()
+	defer q.Unlock()
+	f(job)
+	if persist {
+		q.save()
+	}
+	return *job
+}
+
+func (q *downloadQueue) snapshot(job *downloadJob) downloadJob {
+	q.Lock()
+	defer q.Unlock()
+	return *job
+}
+
+func (q *downloadQueue) find(id string) *downloadJob {
+	for _, j := range q.jobs {
+		if j.ID == id {
+			return j
+		}
+	}
+	return nil
+}
+
+func (q *downloadQueue) list() []downloadJob {
+	q.Lock()
+	defer q.Unlock()
+	result := make([]downloadJob, len(q.jobs))
+	for i, j := range q.jobs {
+		result[i] = *j
+	}
+	return result
+}
+
+// jobProgress is the DOWNLOAD_UPDATE packet data, the websocket is shared by all users so the links, file names and
+// users are left out, the clients get them from the downloads list filtered by the category access
+type jobProgress struct {
+	ID             string   `json:"id"`
+	State          jobState `json:"state"`
+	TotalBytes     int64    `json:"total_bytes"`
+	CompletedBytes int64    `json:"completed_bytes"`
+}
+
+func (u *uploader) jobUpdate(job downloadJob) {
+	u.broker.Broadcast(events.Packet{Type: events.DOWNLOAD_UPDATE, Data: jobProgress{ID: job.ID, State: job.State,
+		TotalBytes: job.TotalBytes, CompletedBytes: job.CompletedBytes}})
+}
+
+func (u *uploader) downloadWorker() {
+	for {
+		job, ctx := u.queue.next()
+		u.jobUpdate(u.queue.snapshot(job))
+		size, err := u.runDownload(ctx, job)
+		state := jobDone
+		if err != nil {
+			state = jobFailed
+			if errors.Is(ctx.Err(), context.Canceled) {
+				state = jobCanceled
+			}
+		}
+		snapshot := u.queue.update(job, true, func(j *downloadJob) {
+			j.cancel()
+			j.cancel = nil
+			j.State = state
+			if state == jobFailed {
+				j.Error = err.Error()
+			}
+		})
+		u.jobUpdate(snapshot)
+		switch state {
+		case jobDone:
+			u.dlSuccess("File %s downloaded", snapshot.Filename)
+			u.downloadComplete(snapshot, size)
+		case jobFailed:
+			u.dlError("Error downloading %s: %s", snapshot.Link, err)
+		case jobCanceled:
+			log.Printf("Download %s canceled", snapshot.Link)
+		}
+	}
+}
+
+// jobAccess finds the job by id and checks that the user can change it, the jobs can be changed by their owners and
+// admins, must be called with the queue lock held
+func (u *uploader) jobAccess(c echo.Context) (*downloadJob, error) {
+	job := u.queue.find(c.Param("id"))
+	if job == nil {
+		return nil, echo.NewHTTPError(404, "download not found")
+	}
+	cat := u.categoryByName(job.Category)
+	if cat == nil || !u.allowed(c, cat) {
+		return nil, echo.NewHTTPError(403, "access denied")
+	}
+	if user := u.user(c); !u.isAdmin(c) && (user == "" || job.User != user) {
+		return nil, echo.NewHTTPError(403, "access denied")
+	}
+	return job, nil
+}
+
+// changeJob runs f on the job under the queue lock and returns the job copy to broadcast after unlocking
+func (u *uploader) changeJob(c echo.Context, f func(job *downloadJob) error) (downloadJob, error) {
+	u.queue.Lock()
+	defer u.queue.Unlock()
+	job, err := u.jobAccess(c)
+	if err != nil {
+		return downloadJob{}, err
+	}
+	if err := f(job); err != nil {
+		return downloadJob{}, err
+	}
+	return *job, nil
+}
+
+func (u *uploader) listDownloads(c echo.Context) error {
+	result := []downloadJob{}
+	for _, j := range u.queue.list() {
+		if cat := u.categoryByName(j.Category); cat != nil && u.allowed(c, cat) {
+			result = append(result, j)
+		}
+	}
+	return JSONOk(c, result)
+}
+
+func (u *uploader) cancelDownload(c echo.Context) error {
+	queued := false
+	job, err := u.changeJob(c, func(job *downloadJob) error {
+		switch job.State {
+		case jobQueued:
+			job.State = jobCanceled
+			u.queue.save()
+			queued = true
+		case jobRunning:
+			job.cancel() // the worker updates the state
+		default:
+			return echo.NewHTTPError(409, "download is already finished")
+		}
+		return nil
+	})
+	if err != nil {
+		return uploadError(c, err)
+	}
+	if queued {
+		u.jobUpdate(job)
+	}
+	return JSONOk(c, job)
+}
+
+func (u *uploader) retryDownload(c echo.Context) error {
+	job, err := u.changeJob(c, func(job *downloadJob) error {
+		if job.State != jobFailed && job.State != jobCanceled {
+			return echo.NewHTTPError(409, "only failed or canceled downloads can be retried")
+		}
+		job.State = jobQueued
+		job.Error = ""
+		job.CompletedBytes = 0
+		u.queue.save()
+		u.queue.cond.Broadcast()
+		return nil
+	})
+	if err != nil {
+		return uploadError(c, err)
+	}
+	u.jobUpdate(job)
+	return JSONOk(c, job)
+}
+
+func (u *uploader) removeDownload(c echo.Context) error {
+	_, err := u.changeJob(c, func(job *downloadJob) error {
+		if !job.finished() {
+			return echo.NewHTTPError(409, "cancel the download first")
+		}
+		u.queue.jobs = slices.DeleteFunc(u.queue.jobs, func(j *downloadJob) bool { return j == job })
+		u.queue.save()
+		return nil
+	})
+	if err != nil {
+		return uploadError(c, err)
+	}
+	return c.NoContent(204)
+}
+
+// queueFile returns the queue location in the staging directory of the first category
+func queueFile(categories []Category) string {
+	if len(categories) == 0 {
+		return ""
+	}
+	return filepath.Join(categories[0].stagingPath(), "queue.json")
+}
@@ -0,0 +1,319 @@
+package upload
+
+import (
+	"encoding/json"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/rkfg/authproxy/civitai"
+)
+
+const (
+	rescanPeriod   = 5 * time.Minute
+	maxIndexTags   = 30
+	defaultPerPage = 50
+	maxPerPage     = 500
+)
+
+// searchEntry is an indexed model file
+type searchEntry struct {
+	Path         string    `json:"path"`
+	Dir          string    `json:"dir"`
+	Name         string    `json:"name"`
+	Ext          string    `json:"ext"`
+	Size         int64     `json:"size"`
+	Modified     time.Time `json:"modified"`
+	Description  string    `json:"description,omitempty"`
+	BaseModel    string    `json:"base_model,omitempty"`
+	TriggerWords []string  `json:"trigger_words,omitempty"`
+	Tags         []string  `json:"tags,omitempty"`
+	Info         *fileInfo `json:"info,omitempty"`
+	text         string    // lowercase text used for the full text search
+}
+
+// searchIndex keeps the metadata of all models in the category, it's built in background and updated by the
+// filesystem watcher
+type searchIndex struct {
+	sync.RWMutex
+	cat     *Category
+	entries map[string]*searchEntry
+	ready   bool
+}
+
+type searchResult struct {
+	Total      int           `json:"total"`
+	Page       int           `json:"page"`
+	PerPage    int           `json:"per_page"`
+	Ready      bool          `json:"ready"`
+	BaseModels []string      `json:"base_models"`
+	Items      []searchEntry `json:"items"`
+}
+
+func newSearchIndex(cat *Category) *searchIndex {
+	return &searchIndex{cat: cat, entries: map[string]*searchEntry{}}
+}
+
+// sidecarMetadata is the format of the .json file written by the CivitAI downloader
+type sidecarMetadata struct {
+	Description    string `json:"description"`
+	SDVersion      string `json:"sd version"`
+	ActivationText string `json:"activation text"`
+}
+
+func splitWords(s string) []string {
+	var result []string
+	for _, w := range strings.FieldsFunc(s, func(r rune) bool { return r == ';' || r == ',' || r == '\n' }) {
+		if w = strings.TrimSpace(w); w != "" {
+			result = append(result, w)
+		}
+	}
+	return result
+}
+
+// readEntry collects the model metadata from the sidecar and the safetensors header
+func (idx *searchIndex) readEntry(fullpath string, fi fs.FileInfo) *searchEntry {
+	cat := idx.cat
+	ext := cat.modelExt(fullpath)
+	rel := cat.indexPath(fullpath)
+	dir := filepath.ToSlash(filepath.Dir(rel))
+	if dir == "." {
+		dir = ""
+	}
+	result := &searchEntry{Path: rel, Dir: dir, Name: strings.TrimSuffix(filepath.Base(fullpath), ext), Ext: ext,
+		Size: fi.Size(), Modified: fi.ModTime(), Info: cat.index.get(rel)}
+	if data, err := os.ReadFile(strings.TrimSuffix(fullpath, ext) + ".json"); err == nil {
+		var meta sidecarMetadata
+		if err := json.Unmarshal(data, &meta); err == nil {
+			result.Description = meta.Description
+			if meta.SDVersion != "unknown" {
+				result.BaseModel = meta.SDVersion
+			}
+			result.TriggerWords = splitWords(meta.ActivationText)
+		}
+	}
+	if strings.EqualFold(ext, ".safetensors") {
+		if header, err := civitai.ReadSafetensorsFile(fullpath); err == nil && header.Metadata != nil {
+			if result.BaseModel == "" {
+				result.BaseModel = header.Metadata["ss_base_model_version"]
+			}
+			result.Tags = civitai.TagFrequency(header.Metadata)
+			if len(result.Tags) > maxIndexTags {
+				result.Tags = result.Tags[:maxIndexTags]
+			}
+		}
+	}
+	result.text = strings.ToLower(strings.Join(append(append([]string{result.Path, result.Description},
+		result.TriggerWords...), result.Tags...), "\n"))
+	return result
+}
+
+// modelFor returns the model file the path belongs to, it's either the model itself or its companion
+func (idx *searchIndex) modelFor(fullpath string) string {
+	if idx.cat.modelExt(fullpath) != "" {
+		return fullpath
+	}
+	for _, suffix := range companionSuffixes {
+		if base, ok := strings.CutSuffix(fullpath, suffix); ok {
+			for _, ext := range idx.cat.Extensions {
+				if exists(base + ext) {
+					return base + ext
+				}
+			}
+		}
+	}
+	return ""
+}
+
+// update reindexes the file or the directory tree at fullpath, removing the entries that no longer exist
+func (idx *searchIndex) update(fullpath string) {
+	rel := idx.cat.indexPath(fullpath)
+	fi, err := os.Stat(fullpath)
+	if err != nil {
+		if model := idx.modelFor(fullpath); model != "" && model != fullpath {
+			idx.update(model)
+			return
+		}
+		idx.Lock()
+		for p := range idx.entries {
+			if p == rel || strings.HasPrefix(p, rel+"/") {
+				delete(idx.entries, p)
+			}
+		}
+		idx.Unlock()
+		return
+	}
+	if !fi.IsDir() {
+		model := idx.modelFor(fullpath)
+		if model == "" {
+			return
+		}
+		if model != fullpath {
+			if fi, err = os.Stat(model); err != nil {
+				return
+			}
+		}
+		entry := idx.readEntry(model, fi)
+		idx.Lock()
+		idx.entries[entry.Path] = entry
+		idx.Unlock()
+		return
+	}
+	found := map[string]*searchEntry{}
+	filepath.WalkDir(fullpath, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return nil
+		}
+		if strings.HasPrefix(d.Name(), ".") && path != fullpath {
+			if d.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if d.IsDir() || idx.cat.modelExt(path) == "" {
+			return nil
+		}
+		fi, err := d.Info()
+		if err != nil {
+			return nil
+		}
+		entry := idx.readEntry(path, fi)
+		found[entry.Path] = entry
+		return nil
+	})
+	idx.Lock()
+	for p := range idx.entries {
+		if rel == "." || p == rel || strings.HasPrefix(p, rel+"/") {
+			delete(idx.entries, p)
+		}
+	}
+	for p, e := range found {
+		idx.entries[p] = e
+	}
+	idx.Unlock()
+}
+
+func (idx *searchIndex) rebuild() {
+	start := time.Now()
+	idx.update(idx.cat.Root)
+	idx.Lock()
+	initial := !idx.ready
+	idx.ready = true
+	count := len(idx.entries)
+	idx.Unlock()
+	if initial {
+		log.Printf("Indexed %d models of %s in %s", count, idx.cat.Name, time.Since(start))
+	}
+}
+
+// poll rebuilds the index periodically, it's used when the filesystem events are not available
+func (idx *searchIndex) poll() {
+	for {
+		idx.rebuild()
+		time.Sleep(rescanPeriod)
+	}
+}
+
+type searchQuery struct {
+	Text      string
+	BaseModel string
+	Tags      []string
+	Owner     string
+	Sort      string
+	Desc      bool
+	Page      int
+	PerPage   int
+}
+
+func (e *searchEntry) matches(q *searchQuery) bool {
+	if q.BaseModel != "" && !strings.EqualFold(e.BaseModel, q.BaseModel) {
+		return false
+	}
+	if q.Owner != "" && (e.Info == nil || e.Info.Owner != q.Owner) {
+		return false
+	}
+	for _, tag := range q.Tags {
+		equal := func(t string) bool { return strings.EqualFold(t, tag) }
+		if !slices.ContainsFunc(e.Tags, equal) && !slices.ContainsFunc(e.TriggerWords, equal) {
+			return false
+		}
+	}
+	for _, word := range strings.Fields(strings.ToLower(q.Text)) {
+		if !strings.Contains(e.text, word) {
+			return false
+		}
+	}
+	return true
+}
+
+func (idx *searchIndex) search(q *searchQuery) searchResult {
+	idx.RLock()
+	result := searchResult{Page: q.Page, PerPage: q.PerPage, Ready: idx.ready, BaseModels: []string{}, Items: []searchEntry{}}
+	baseModels := map[string]struct{}{}
+	var items []searchEntry
+	for _, e := range idx.entries {
+		if e.BaseModel != "" {
+			baseModels[e.BaseModel] = struct{}{}
+		}
+		if e.matches(q) {
+			items = append(items, *e)
+		}
+	}
+	idx.RUnlock()
+	for bm := range baseModels {
+		result.BaseModels = append(result.BaseModels, bm)
+	}
+	sort.Strings(result.BaseModels)
+	sort.Slice(items, func(i, j int) bool {
+		a, b := items[i], items[j]
+		if q.Desc {
+			a, b = b, a
+		}
+		switch q.Sort {
+		case "modified":
+			if !a.Modified.Equal(b.Modified) {
+				return a.Modified.Before(b.Modified)
+			}
+		case "size":
+			if a.Size != b.Size {
+				return a.Size < b.Size
+			}
+		}
+		return strings.ToLower(a.Path) < strings.ToLower(b.Path)
+	})
+	result.Total = len(items)
+	from := min((q.Page-1)*q.PerPage, len(items))
+	to := min(from+q.PerPage, len(items))
+	result.Items = append(result.Items, items[from:to]...)
+	return result
+}
+
+func (u *uploader) search(c echo.Context) error {
+	cat, err := u.category(c)
+	if err != nil {
+		return JSONError(c, 403, err)
+	}
+	q := searchQuery{Text: c.QueryParam("q"), BaseModel: c.QueryParam("base_model"), Tags: c.QueryParams()["tag"],
+		Sort: c.QueryParam("sort"), Desc: c.QueryParam("order") == "desc", Page: 1, PerPage: defaultPerPage}
+	if c.QueryParam("mine") == "true" {
+		q.Owner = u.user(c)
+		if q.Owner == "" {
+			return JSONOk(c, searchResult{Page: 1, PerPage: q.PerPage, BaseModels: []string{}, Items: []searchEntry{}})
+		}
+	}
+	if page, err := strconv.Atoi(c.QueryParam("page")); err == nil && page > 0 {
+		q.Page = page
+	}
+	if perPage, err := strconv.Atoi(c.QueryParam("per_page")); err == nil && perPage > 0 {
+		q.PerPage = min(perPage, maxPerPage)
+	}
+	return JSONOk(c, cat.search.search(&q))
+}
@@ -0,0 +1,415 @@
+package upload
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"path"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/labstack/echo/v4"
+	"github.com/rkfg/authproxy/civitai"
+)
+
+// SourceConfig limits what can be downloaded from a source, Allow contains path.Match patterns checked against the
+// CivitAI model ID, the HuggingFace owner/repo or the direct link host
+type SourceConfig struct {
+	Disabled bool     `yaml:"disabled"`
+	Allow    []string `yaml:"allow,flow"`
+	Token    string   `yaml:"token"`
+	BaseURL  string   `yaml:"base_url"` // deprecated CivitAI only alias of civitai.base_url
+}
+
+// SourcesConfig configures the remote download sources, direct links are only accepted from the allowed hosts
+type SourcesConfig struct {
+	CivitAI     SourceConfig `yaml:"civitai"`
+	HuggingFace SourceConfig `yaml:"huggingface"`
+	Direct      SourceConfig `yaml:"direct"`
+}
+
+// previewer is implemented by the sources that can list the model versions and files before downloading
+type previewer interface {
+	preview(req *sourceRequest, cat *Category) (*modelPreview, error)
+}
+
+// errNotMatched means the URL belongs to another source
+var errNotMatched = errors.New("URL not supported by the source")
+
+// sourceRequest is the URL to download and the optional choice made in the preview
+type sourceRequest struct {
+	URL       *url.URL
+	VersionID string
+	FileID    string
+}
+
+// downloadSource validates the remote URLs and turns them into download jobs
+type downloadSource interface {
+	name() string
+	// resolve returns a job with Link, Filename (if known) and SHA256 (if known) set or errNotMatched
+	resolve(req *sourceRequest, cat *Category) (*downloadJob, error)
+	// authorize adds the source credentials to the download request
+	authorize(req *http.Request)
+}
+
+func (sc *SourceConfig) allowed(key string) bool {
+	if len(sc.Allow) == 0 {
+		return true
+	}
+	for _, pattern := range sc.Allow {
+		if ok, _ := path.Match(pattern, key); ok {
+			return true
+		}
+	}
+	return false
+}
+
+func newSources(cfg SourcesConfig, civitaiClient *civitai.Client) []downloadSource {
+	var result []downloadSource
+	if !cfg.CivitAI.Disabled {
+		result = append(result, &civitaiSource{cfg: cfg.CivitAI, client: civitaiClient})
+	}
+	if !cfg.HuggingFace.Disabled {
+		result = append(result, &hfSource{cfg: cfg.HuggingFace})
+	}
+	if !cfg.Direct.Disabled && len(cfg.Direct.Allow) > 0 {
+		result = append(result, &directSource{cfg: cfg.Direct})
+	}
+	return result
+}
+
+func (u *uploader) sourceByName(name string) downloadSource {
+	for _, s := range u.sources {
+		if s.name() == name {
+			return s
+		}
+	}
+	return nil
+}
+
+type civitaiSource struct {
+	cfg    SourceConfig
+	client *civitai.Client
+}
+
+var (
+	modelRegex      = regexp.MustCompile(`^/models/(\d+)`)
+	civitaiDLRegexp = regexp.MustCompile(`^/api/download/models/(\d+)$`)
+)
+
+type civitaiFile struct {
+	ID          int     `json:"id"`
+	Name        string  `json:"name"`
+	SizeKB      float64 `json:"sizeKB"`
+	Type        string  `json:"type"`
+	Primary     bool    `json:"primary"`
+	DownloadURL string  `json:"downloadUrl"`
+	Metadata    struct {
+		Format string `json:"format"`
+		Size   string `json:"size"`
+		FP     string `json:"fp"`
+	} `json:"metadata"`
+	Hashes struct {
+		SHA256 string `json:"SHA256"`
+	} `json:"hashes"`
+}
+
+type modelVersion struct {
+	ID           int           `json:"id"`
+	ModelID      int           `json:"modelId"`
+	Name         string        `json:"name"`
+	BaseModel    string        `json:"baseModel"`
+	TrainedWords []string      `json:"trainedWords"`
+	Files        []civitaiFile `json:"files"`
+}
+
+// file returns the file by ID or the primary one if id is empty
+func (mv *modelVersion) file(id string) (*civitaiFile, error) {
+	for i, f := range mv.Files {
+		if (id == "" && f.Primary) || (id != "" && strconv.Itoa(f.ID) == id) {
+			return &mv.Files[i], nil
+		}
+	}
+	if id == "" && len(mv.Files) > 0 {
+		return &mv.Files[0], nil
+	}
+	return nil, fmt.Errorf("file %s not found in version %s", id, mv.Name)
+}
+
+func (s *civitaiSource) name() string {
+	return "civitai"
+}
+
+// authorize sends the API key if it's configured, the cookie jar of the download client is used if there's no key or
+// it's rejected
+func (s *civitaiSource) authorize(req *http.Request) {
+	s.client.Authorize(req)
+}
+
+// cookieSession checks if CivitAI accepts the session cookie of the download client
+func (u *uploader) cookieSession() Result {
+	if u.dlclient.Jar == nil {
+		return Result{"auth": "none", "valid": false}
+	}
+	resp, err := u.dlclient.Get(u.civitai.BaseURL() + "/api/auth/session")
+	if err != nil {
+		return Result{"auth": "cookie", "valid": false, "error": err.Error()}
+	}
+	defer resp.Body.Close()
+	var session struct {
+		User struct {
+			Username string
+		}
+	}
+	if resp.StatusCode != http.StatusOK {
+		return Result{"auth": "cookie", "valid": false, "error": fmt.Sprintf("CivitAI returned code %d", resp.StatusCode)}
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&session); err != nil || session.User.Username == "" {
+		return Result{"auth": "cookie", "valid": false, "error": "the session cookie is expired"}
+	}
+	return Result{"auth": "cookie", "valid": true, "user": session.User.Username}
+}
+
+// civitaiHealth reports which CivitAI credential is used and whether CivitAI accepts it, if the API key is rejected
+// the cookie used instead is reported as the fallback
+func (u *uploader) civitaiHealth(c echo.Context) error {
+	if !u.civitai.HasToken() {
+		return JSONOk(c, u.cookieSession())
+	}
+	user, err := u.civitai.CheckToken()
+	if err != nil {
+		return JSONOk(c, Result{"auth": "token", "valid": false, "error": err.Error(), "fallback": u.cookieSession()})
+	}
+	return JSONOk(c, Result{"auth": "token", "valid": true, "user": user})
+}
+
+func (s *civitaiSource) get(apiPath string, result any) error {
+	if err := s.client.API(apiPath, result); err != nil {
+		return fmt.Errorf("error accessing CivitAI: %w", err)
+	}
+	return nil
+}
+
+func (s *civitaiSource) checkModel(id string, modelType string, cat *Category) error {
+	if !s.cfg.allowed(id) {
+		return fmt.Errorf("model %s is not allowed", id)
+	}
+	if !cat.modelAllowed(modelType) {
+		return fmt.Errorf("%s is not allowed in %s", modelType, cat.Title)
+	}
+	return nil
+}
+
+type civitaiModel struct {
+	ID            int            `json:"id"`
+	Name          string         `json:"name"`
+	Type          string         `json:"type"`
+	ModelVersions []modelVersion `json:"modelVersions"`
+}
+
+// model returns the model with all versions and the version ID selected by the request or the URL, the ID is empty
+// if none was selected
+func (s *civitaiSource) model(req *sourceRequest) (*civitaiModel, string, error) {
+	if !s.client.IsSiteHost(strings.TrimPrefix(req.URL.Host, "www.")) {
+		return nil, "", errNotMatched
+	}
+	versionID := req.VersionID
+	modelID := ""
+	if m := civitaiDLRegexp.FindStringSubmatch(req.URL.Path); m != nil {
+		if versionID == "" {
+			versionID = m[1]
+		}
+	} else if m := modelRegex.FindStringSubmatch(req.URL.Path); m != nil {
+		modelID = m[1]
+		if versionID == "" {
+			versionID = req.URL.Query().Get("modelVersionId")
+		}
+	} else {
+		return nil, "", fmt.Errorf("use the model page or download URL")
+	}
+	if _, err := strconv.Atoi(versionID); versionID != "" && err != nil {
+		return nil, "", fmt.Errorf("invalid version ID %s", versionID)
+	}
+	if modelID == "" {
+		var mv modelVersion
+		if err := s.get("model-versions/"+versionID, &mv); err != nil {
+			return nil, "", err
+		}
+		modelID = strconv.Itoa(mv.ModelID)
+	}
+	var result civitaiModel
+	if err := s.get("models/"+modelID, &result); err != nil {
+		return nil, "", err
+	}
+	return &result, versionID, nil
+}
+
+func (cm *civitaiModel) version(id string) (*modelVersion, error) {
+	if len(cm.ModelVersions) == 0 {
+		return nil, fmt.Errorf("no model versions found")
+	}
+	if id == "" {
+		return &cm.ModelVersions[0], nil
+	}
+	for i, mv := range cm.ModelVersions {
+		if strconv.Itoa(mv.ID) == id {
+			return &cm.ModelVersions[i], nil
+		}
+	}
+	return nil, fmt.Errorf("version %s not found", id)
+}
+
+func (s *civitaiSource) resolve(req *sourceRequest, cat *Category) (*downloadJob, error) {
+	model, versionID, err := s.model(req)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.checkModel(strconv.Itoa(model.ID), model.Type, cat); err != nil {
+		return nil, err
+	}
+	mv, err := model.version(versionID)
+	if err != nil {
+		return nil, err
+	}
+	file, err := mv.file(req.FileID)
+	if err != nil {
+		return nil, err
+	}
+	if err := cat.validateFilename(file.Name); err != nil {
+		if req.FileID != "" {
+			return nil, err
+		}
+		// the primary file has an unsupported format, take the first suitable one
+		idx := slices.IndexFunc(mv.Files, func(f civitaiFile) bool { return cat.validateFilename(f.Name) == nil })
+		if idx < 0 {
+			return nil, err
+		}
+		file = &mv.Files[idx]
+	}
+	link := file.DownloadURL
+	if link == "" {
+		link = fmt.Sprintf("%s/api/download/models/%d", s.client.BaseURL(), mv.ID)
+	}
+	return &downloadJob{Link: link, SHA256: strings.ToLower(file.Hashes.SHA256), Filename: file.Name}, nil
+}
+
+type previewFile struct {
+	ID        int    `json:"id"`
+	Name      string `json:"name"`
+	Type      string `json:"type"`
+	Size      int64  `json:"size"`
+	Format    string `json:"format"`
+	FP        string `json:"fp"`
+	ModelSize string `json:"model_size"`
+	Primary   bool   `json:"primary"`
+	Allowed   bool   `json:"allowed"`
+}
+
+type previewVersion struct {
+	ID           int           `json:"id"`
+	Name         string        `json:"name"`
+	BaseModel    string        `json:"base_model"`
+	TrainedWords []string      `json:"trained_words"`
+	Files        []previewFile `json:"files"`
+}
+
+type modelPreview struct {
+	Source   string           `json:"source"`
+	ID       int              `json:"id,omitempty"`
+	Name     string           `json:"name"`
+	Type     string           `json:"type,omitempty"`
+	Error    string           `json:"error,omitempty"` // the reason the model can't be downloaded to the category
+	Selected int              `json:"selected,omitempty"`
+	Versions []previewVersion `json:"versions,omitempty"`
+}
+
+func (s *civitaiSource) preview(req *sourceRequest, cat *Category) (*modelPreview, error) {
+	model, versionID, err := s.model(req)
+	if err != nil {
+		return nil, err
+	}
+	result := &modelPreview{Source: s.name(), ID: model.ID, Name: model.Name, Type: model.Type}
+	if err := s.checkModel(strconv.Itoa(model.ID), model.Type, cat); err != nil {
+		result.Error = err.Error()
+	}
+	if mv, err := model.version(versionID); err == nil {
+		result.Selected = mv.ID
+	}
+	for _, mv := range model.ModelVersions {
+		pv := previewVersion{ID: mv.ID, Name: mv.Name, BaseModel: mv.BaseModel, TrainedWords: mv.TrainedWords, Files: []previewFile{}}
+		for _, f := range mv.Files {
+			pv.Files = append(pv.Files, previewFile{ID: f.ID, Name: f.Name, Type: f.Type, Size: int64(f.SizeKB * 1024), Format: f.Metadata.Format,
+				FP: f.Metadata.FP, ModelSize: f.Metadata.Size, Primary: f.Primary, Allowed: cat.validateFilename(f.Name) == nil})
+		}
+		result.Versions = append(result.Versions, pv)
+	}
+	return result, nil
+}
+
+type hfSource struct {
+	cfg SourceConfig
+}
+
+// hfRegexp matches the file URLs: /<owner>/<repo>/(resolve|blob)/<revision>/<path>
+var hfRegexp = regexp.MustCompile(`^/([\w.-]+)/([\w.-]+)/(?:resolve|blob)/([^/]+)/(.+)$`)
+
+func (s *hfSource) name() string {
+	return "huggingface"
+}
+
+func (s *hfSource) authorize(req *http.Request) {
+	if s.cfg.Token != "" && req.URL.Host == "huggingface.co" {
+		req.Header.Set("Authorization", "Bearer "+s.cfg.Token)
+	}
+}
+
+func (s *hfSource) resolve(req *sourceRequest, cat *Category) (*downloadJob, error) {
+	u := req.URL
+	if u.Host != "huggingface.co" && u.Host != "hf.co" {
+		return nil, errNotMatched
+	}
+	m := hfRegexp.FindStringSubmatch(u.Path)
+	if m == nil {
+		return nil, fmt.Errorf("use the repository file URL")
+	}
+	repo := m[1] + "/" + m[2]
+	if !s.cfg.allowed(repo) {
+		return nil, fmt.Errorf("repository %s is not allowed", repo)
+	}
+	filename := path.Base(m[4])
+	if err := cat.validateFilename(filename); err != nil {
+		return nil, err
+	}
+	link := url.URL{Scheme: "https", Host: "huggingface.co", Path: fmt.Sprintf("/%s/resolve/%s/%s", repo, m[3], m[4])}
+	return &downloadJob{Link: link.String(), Filename: filename}, nil
+}
+
+type directSource struct {
+	cfg SourceConfig
+}
+
+func (s *directSource) name() string {
+	return "direct"
+}
+
+func (s *directSource) authorize(req *http.Request) {}
+
+func (s *directSource) resolve(req *sourceRequest, cat *Category) (*downloadJob, error) {
+	u := req.URL
+	if !s.cfg.allowed(u.Hostname()) {
+		return nil, errNotMatched
+	}
+	if u.Scheme != "https" {
+		return nil, fmt.Errorf("only HTTPS links are supported")
+	}
+	// the name from the path is used if the server doesn't send Content-Disposition
+	filename := path.Base(u.Path)
+	if cat.validateFilename(filename) != nil {
+		filename = ""
+	}
+	return &downloadJob{Link: u.String(), Filename: filename}, nil
+}
@@ -0,0 +1,88 @@
+package upload
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/labstack/echo/v4"
+	"github.com/rkfg/authproxy/civitai"
+)
+
+// stubCivitAI accepts the "good" API key and the "session" cookie
+func stubCivitAI(t *testing.T) *httptest.Server {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/v1/me", func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer good" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		w.Write([]byte(`{"username": "apiuser"}`))
+	})
+	mux.HandleFunc("/api/auth/session", func(w http.ResponseWriter, r *http.Request) {
+		if c, err := r.Cookie(civitaiToken); err != nil || c.Value != "session" {
+			w.Write([]byte(`{}`))
+			return
+		}
+		w.Write([]byte(`{"user": {"username": "webuser"}}`))
+	})
+	srv := httptest.NewServer(mux)
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func TestCivitAIHealth(t *testing.T) {
+	srv := stubCivitAI(t)
+	tests := []struct {
+		name     string
+		token    string
+		cookie   string
+		auth     string
+		valid    bool
+		user     string
+		fallback bool // the cookie is reported as the valid fallback
+	}{
+		{name: "valid token", token: "good", cookie: "session", auth: "token", valid: true, user: "apiuser"},
+		{name: "rejected token", token: "bad", cookie: "session", auth: "token", fallback: true},
+		{name: "rejected token without cookie", token: "bad", auth: "token"},
+		{name: "valid cookie", cookie: "session", auth: "cookie", valid: true, user: "webuser"},
+		{name: "expired cookie", cookie: "old", auth: "cookie"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cookieFile := filepath.Join(t.TempDir(), "cookie")
+			if err := os.WriteFile(cookieFile, []byte(tt.cookie), 0644); err != nil {
+				t.Fatal(err)
+			}
+			u := &uploader{civitai: civitai.NewClient(civitai.ClientConfig{BaseURL: srv.URL, Token: tt.token}),
+				cookieFile: cookieFile}
+			u.loadCookies()
+			rec := httptest.NewRecorder()
+			if err := u.civitaiHealth(echo.New().NewContext(httptest.NewRequest("GET", "/civitai/health", nil), rec)); err != nil {
+				t.Fatal(err)
+			}
+			var result struct {
+				Auth     string
+				Valid    bool
+				User     string
+				Fallback *struct {
+					Valid bool
+					User  string
+				}
+			}
+			if err := json.NewDecoder(rec.Body).Decode(&result); err != nil {
+				t.Fatal(err)
+			}
+			if result.Auth != tt.auth || result.Valid != tt.valid || result.User != tt.user {
+				t.Errorf("got auth %s, valid %t, user %q, want %s, %t, %q", result.Auth, result.Valid, result.User,
+					tt.auth, tt.valid, tt.user)
+			}
+			if fallback := result.Fallback != nil && result.Fallback.Valid; fallback != tt.fallback {
+				t.Errorf("got valid fallback %t, want %t", fallback, tt.fallback)
+			}
+		})
+	}
+}
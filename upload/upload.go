@@ -1,8 +1,10 @@
 package upload
 
 import (
+	"context"
+	"crypto/sha256"
 	"embed"
-	"encoding/json"
+	"encoding/hex"
 	"fmt"
 	"html"
 	"io"
@@ -14,9 +16,11 @@ import (
 	"os"
 	"path/filepath"
 	"regexp"
+	"slices"
 	"sort"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/labstack/echo/v4"
@@ -30,39 +34,52 @@ var webroot embed.FS
 
 const civitaiToken = "__Secure-civitai-token"
 
-type dlTask struct {
-	link string
-	dir  string
+// Config holds the uploader settings and the hooks into the authentication
+type Config struct {
+	Categories []Category
+	CookieFile string
+	User       func(c echo.Context) string
+	HasRole    func(c echo.Context, role string) bool
+	Workers    int // number of parallel downloads
+	Sources    SourcesConfig
+	AdminRole  string        // role required to rename, move and delete files
+	Retention  time.Duration // how long the deleted files are kept in trash
+	BaseModels []civitai.BaseModelRule
+	Previews   civitai.PreviewConfig
+	CivitAI    *civitai.Client // shared with the metadata downloader, the Sources.CivitAI token is used if it's nil
 }
 
 type uploader struct {
-	root       string
-	broker     *events.Broker
-	dlc        chan dlTask
-	pageclient http.Client
-	dlclient   http.Client
-	cookieFile string
-	civitdl    *civitai.Downloader
-	m          chan<- metrics.MetricUpdate
-}
-
-type downloadProgress struct {
-	Filename       string `json:"filename"`
-	TotalBytes     int64  `json:"total_bytes"`
-	CompletedBytes int64  `json:"completed_bytes"`
+	categories     []Category
+	user           func(c echo.Context) string
+	hasRole        func(c echo.Context, role string) bool
+	broker         *events.Broker
+	queue          *downloadQueue
+	sources        []downloadSource
+	adminRole      string
+	trashRetention time.Duration
+	dlclient       http.Client
+	cookieFile     string
+	civitai        *civitai.Client
+	civitdl        *civitai.Downloader
+	m              chan<- metrics.MetricUpdate
+	chunksLock     sync.Mutex
+	activeChunks   map[string]struct{}
 }
 
 type Result map[string]interface{}
 
 type fileItem struct {
-	Type      string `json:"type"`
-	Name      string `json:"name"`
-	Timestamp int64  `json:"timestamp"`
+	Type      string    `json:"type"`
+	Name      string    `json:"name"`
+	Ext       string    `json:"ext,omitempty"`
+	Timestamp int64     `json:"timestamp"`
+	Info      *fileInfo `json:"info,omitempty"`
+	CanModify bool      `json:"can_modify"`
 }
 
 var (
 	validateRegexp = regexp.MustCompile(`[*<>]`)
-	modelRegex     = regexp.MustCompile(`/models/(\d+)`)
 )
 
 func JSONOk(c echo.Context, r interface{}) error {
@@ -77,37 +94,21 @@ func JSONErrorMessage(c echo.Context, code int, msg string) error {
 	return c.JSON(code, Result{"message": msg})
 }
 
-func (u *uploader) fullPath(dir string) (string, error) {
-	if dir != "" && !filepath.IsLocal(dir) {
-		return "", fmt.Errorf("invalid path")
-	}
-	return filepath.Join(u.root, dir), nil
-}
-
 func validateName(dir string) bool {
 	return !validateRegexp.MatchString(dir)
 }
 
-func validateFilename(fn string) error {
-	if !filepath.IsLocal(fn) {
-		return fmt.Errorf("invalid file name")
-	}
-	if !validateName(fn) {
-		return fmt.Errorf("invalid file name")
-	}
-	if !strings.HasSuffix(fn, ".safetensors") {
-		return fmt.Errorf("only safetensors are supported")
-	}
-	return nil
-}
-
 func (u *uploader) postFiles(c echo.Context) error {
 	dir := c.FormValue("dir")
 	if !validateName(dir) {
 		return JSONErrorMessage(c, 400, "Invalid directory name")
 	}
 	typ := c.FormValue("type")
-	fullpath, err := u.fullPath(dir)
+	cat, err := u.category(c)
+	if err != nil {
+		return JSONError(c, 403, err)
+	}
+	fullpath, err := cat.fullPath(dir)
 	if err != nil {
 		return JSONError(c, 400, err)
 	}
@@ -117,15 +118,45 @@ func (u *uploader) postFiles(c echo.Context) error {
 			return JSONError(c, 500, err)
 		}
 		return nil
+	case "move":
+		if !u.canModify(c, cat, c.FormValue("path")) {
+			return JSONErrorMessage(c, 403, "access denied")
+		}
+		if err := cat.moveEntry(c.FormValue("path"), c.FormValue("target")); err == errExists {
+			return JSONError(c, 409, err)
+		} else if err != nil {
+			return JSONError(c, 400, err)
+		}
+		return JSONOk(c, Result{})
+	case "delete":
+		if !u.canModify(c, cat, c.FormValue("path")) {
+			return JSONErrorMessage(c, 403, "access denied")
+		}
+		entry, err := cat.deleteEntry(c.FormValue("path"), u.user(c))
+		if err != nil {
+			return JSONError(c, 400, err)
+		}
+		return JSONOk(c, entry)
 	case "upload_file":
 		file, err := c.FormFile("file")
 		if err != nil {
 			return JSONError(c, 400, err)
 		}
-		if file.Size > 1024*1024*1024 { // 1 Gb
+		if cat.tooBig(file.Size) {
 			return JSONErrorMessage(c, 400, "file too big")
 		}
-		if err := validateFilename(file.Filename); err != nil {
+		if err := cat.validateFilename(file.Filename); err != nil {
+			return JSONError(c, 400, err)
+		}
+		target := filepath.Join(fullpath, file.Filename)
+		replace := c.FormValue("replace") == "true"
+		if !replace && exists(target) {
+			return JSONError(c, 409, errExists)
+		}
+		if !u.canReplace(c, cat, dir, file.Filename) {
+			return JSONErrorMessage(c, 403, "access denied")
+		}
+		if err := cat.checkQuota(dir, u.user(c), file.Size, target); err != nil {
 			return JSONError(c, 400, err)
 		}
 		source, err := file.Open()
@@ -133,19 +164,33 @@ func (u *uploader) postFiles(c echo.Context) error {
 			return JSONError(c, 400, err)
 		}
 		defer source.Close()
-		target, err := os.Create(filepath.Join(fullpath, file.Filename))
+		tmp, err := cat.createTemp()
 		if err != nil {
-			return JSONError(c, 400, err)
+			return JSONError(c, 500, err)
+		}
+		defer os.Remove(tmp.Name())
+		h := sha256.New()
+		_, err = io.Copy(io.MultiWriter(tmp, h), source)
+		if cerr := tmp.Close(); err == nil {
+			err = cerr
 		}
-		defer target.Close()
-		_, err = io.Copy(target, source)
 		if err != nil {
 			return JSONError(c, 400, err)
 		}
+		if err := validateModel(tmp.Name(), file.Filename); err != nil {
+			return JSONError(c, 400, err)
+		}
+		owner := cat.ownerAfterWrite(target, u.user(c))
+		if err := placeFile(tmp.Name(), target, replace); err == errExists {
+			return JSONError(c, 409, err)
+		} else if err != nil {
+			return JSONError(c, 500, err)
+		}
+		cat.recordFile(target, fileInfo{Owner: owner, Source: "upload", SHA256: hex.EncodeToString(h.Sum(nil))})
 		u.m <- metrics.MetricUpdate{Type: metrics.UPLOAD_COUNT, Value: 1}
 		u.m <- metrics.MetricUpdate{Type: metrics.UPLOAD_SIZE, Value: float64(file.Size)}
 		go func() {
-			err := u.civitdl.UpdateFile(target.Name())
+			err := u.civitdl.UpdateFile(target)
 			if err != nil {
 				log.Printf("Error getting metadata from CivitAI: %s", err)
 			}
@@ -156,7 +201,11 @@ func (u *uploader) postFiles(c echo.Context) error {
 
 func (u *uploader) listFiles(c echo.Context) error {
 	dir := c.QueryParam("dir")
-	fullpath, err := u.fullPath(dir)
+	cat, err := u.category(c)
+	if err != nil {
+		return JSONError(c, 403, err)
+	}
+	fullpath, err := cat.fullPath(dir)
 	if err != nil {
 		return JSONError(c, 400, err)
 	}
@@ -173,19 +222,34 @@ func (u *uploader) listFiles(c echo.Context) error {
 		}
 		return strings.Compare(strings.ToLower(files[i].Name()), strings.ToLower(files[j].Name())) < 0
 	})
+	user := u.user(c)
+	admin := u.isAdmin(c)
+	mine := c.QueryParam("mine") == "true"
 	result := []fileItem{}
 	for _, f := range files {
 		t := "file"
 		name := f.Name()
+		ext := ""
 		if f.IsDir() {
+			if strings.HasPrefix(name, ".") || strings.HasSuffix(name, civitai.GallerySuffix) {
+				continue
+			}
 			t = "dir"
 		} else {
-			if !strings.HasSuffix(strings.ToLower(f.Name()), ".safetensors") {
+			if ext = cat.modelExt(name); ext == "" {
+				continue
+			}
+			name = strings.TrimSuffix(name, ext)
+		}
+		fi := fileItem{Type: t, Name: html.EscapeString(name), Ext: ext, CanModify: admin}
+		if !f.IsDir() {
+			fi.Info = cat.index.get(cat.indexPath(filepath.Join(fullpath, f.Name())))
+			owned := fi.Info != nil && user != "" && fi.Info.Owner == user
+			if mine && !owned {
 				continue
 			}
-			name = strings.TrimSuffix(f.Name(), ".safetensors")
+			fi.CanModify = admin || owned
 		}
-		fi := fileItem{Type: t, Name: html.EscapeString(name)}
 		if info, err := f.Info(); err != nil {
 			log.Printf("Error getting file %s info: %s", f.Name(), err)
 		} else {
@@ -196,17 +260,20 @@ func (u *uploader) listFiles(c echo.Context) error {
 	return JSONOk(c, result)
 }
 
-func modelAllowed(modelType string) bool {
-	t := strings.ToLower(modelType)
-	return t == "lora" || t == "locon" || t == "dora"
-}
-
 func (u *uploader) download(c echo.Context) error {
 	var params struct {
-		URL string `form:"url"`
-		Dir string `form:"dir"`
+		URL       string `form:"url"`
+		Dir       string `form:"dir"`
+		Replace   bool   `form:"replace"`
+		VersionID string `form:"version_id"`
+		FileID    string `form:"file_id"`
 	}
 	c.Bind(&params)
+	cat, err := u.category(c)
+	if err != nil {
+		u.dlError("%s", err)
+		return nil
+	}
 	if !validateName(params.Dir) {
 		u.dlError("Invalid directory name: %s", params.Dir)
 		return nil
@@ -216,64 +283,76 @@ func (u *uploader) download(c echo.Context) error {
 		u.dlError("Invalid URL: %s", err.Error())
 		return nil
 	}
-	if cu.Host != "civitai.com" && cu.Host != "civitai.red" {
-		u.dlError("Only civitai.com and civitai.red is supported")
-		return nil
-	}
-	m := modelRegex.FindStringSubmatch(cu.Path)
-	if m == nil {
-		u.dlError("Use the model page URL")
-		return nil
-	}
-	mvid := cu.Query().Get("modelVersionId")
-	if mvid != "" {
-		resp, err := u.pageclient.Get("https://civitai.com/api/v1/model-versions/" + mvid)
-		if err != nil {
-			u.dlError("Error accessing CivitAI: %s", err)
-			return nil
-		}
-		if resp.StatusCode != 200 {
-			u.dlError("Error accessing CivitAI: code %d", resp.StatusCode)
+	req := sourceRequest{URL: cu, VersionID: params.VersionID, FileID: params.FileID}
+	for _, src := range u.sources {
+		job, err := src.resolve(&req, cat)
+		if err == errNotMatched {
+			continue
 		}
-		var respModel struct {
-			DownloadURL string `json:"downloadUrl"`
-			Model       struct {
-				Type string `json:"type"`
-			}
-		}
-		json.NewDecoder(resp.Body).Decode(&respModel)
-		if !modelAllowed(respModel.Model.Type) {
-			u.dlError("Only LoRA download is supported, this is %s", respModel.Model.Type)
+		if err != nil {
+			u.dlError("%s", err)
 			return nil
 		}
-		u.dlc <- dlTask{link: respModel.DownloadURL, dir: params.Dir}
-	} else {
-		resp, err := u.pageclient.Get("https://civitai.com/api/v1/models/" + m[1])
+		id, err := newUploadID()
 		if err != nil {
-			u.dlError("Error accessing CivitAI: %s", err)
+			u.dlError("Error creating download: %s", err)
 			return nil
 		}
-		if resp.StatusCode != 200 {
-			u.dlError("Error accessing CivitAI: code %d", resp.StatusCode)
+		job.ID = id
+		job.Source = src.name()
+		job.Dir = params.Dir
+		job.Category = cat.Name
+		job.Replace = params.Replace
+		job.URL = params.URL
+		job.User = u.user(c)
+		job.Admin = u.isAdmin(c)
+		if job.Replace && job.Filename != "" && !u.canReplace(c, cat, job.Dir, job.Filename) {
+			u.dlError("File %s belongs to another user", job.Filename)
+			return nil
 		}
-		var respModel struct {
-			Type          string `json:"type"`
-			ModelVersions []struct {
-				DownloadURL string `json:"downloadUrl"`
+		job.State = jobQueued
+		job.Created = time.Now()
+		snapshot := u.queue.add(job)
+		u.jobUpdate(snapshot)
+		return JSONOk(c, snapshot)
+	}
+	u.dlError("Downloads from %s are not supported", cu.Host)
+	return nil
+}
+
+// downloadPreview shows the model versions and files to choose from, the sources without preview support return
+// the resolved file name
+func (u *uploader) downloadPreview(c echo.Context) error {
+	cat, err := u.category(c)
+	if err != nil {
+		return JSONError(c, 403, err)
+	}
+	cu, err := url.Parse(c.QueryParam("url"))
+	if err != nil {
+		return JSONError(c, 400, err)
+	}
+	req := sourceRequest{URL: cu}
+	for _, src := range u.sources {
+		if p, ok := src.(previewer); ok {
+			result, err := p.preview(&req, cat)
+			if err == errNotMatched {
+				continue
+			}
+			if err != nil {
+				return JSONError(c, 400, err)
 			}
+			return JSONOk(c, result)
 		}
-		json.NewDecoder(resp.Body).Decode(&respModel)
-		if !modelAllowed(respModel.Type) {
-			u.dlError("Only LoRA download is supported, this is %s", respModel.Type)
-			return nil
+		job, err := src.resolve(&req, cat)
+		if err == errNotMatched {
+			continue
 		}
-		if len(respModel.ModelVersions) == 0 {
-			u.dlError("No model versions found.")
-			return nil
+		if err != nil {
+			return JSONError(c, 400, err)
 		}
-		u.dlc <- dlTask{link: respModel.ModelVersions[0].DownloadURL, dir: params.Dir}
+		return JSONOk(c, modelPreview{Source: src.name(), Name: job.Filename})
 	}
-	return nil
+	return JSONErrorMessage(c, 400, fmt.Sprintf("Downloads from %s are not supported", cu.Host))
 }
 
 func (u *uploader) dlMsg(msgType string, msg string, params ...any) {
@@ -290,77 +369,145 @@ func (u *uploader) dlSuccess(msg string, params ...any) {
 	log.Printf("Success: "+msg, params...)
 }
 
-func (u *uploader) startDownloader() {
-	for task := range u.dlc {
-		func() {
-			req, err := http.NewRequest("GET", task.link, nil)
-			if err != nil {
-				u.dlError("Error making request: %s", err)
-				return
-			}
-			resp, err := u.dlclient.Do(req)
-			if err != nil {
-				u.dlError("Error downloading %s: %s", task.link, err)
-				return
-			}
-			disp := resp.Header.Get(echo.HeaderContentDisposition)
-			_, params, err := mime.ParseMediaType(disp)
-			if err != nil {
-				u.dlError("Error parsing disposition (check if you can download the file in incognito), disposition: '%s': %s", disp, err)
-				return
-			}
-			fn := params["filename"]
-			fullpath, err := u.fullPath(task.dir)
-			if err != nil {
-				u.dlError("Invalid directory %s: %s", task.dir, err)
-				return
-			}
-			if err := validateFilename(fn); err != nil {
-				u.dlError("Invalid filename %s: %s", fn, err)
-				return
-			}
-			fullpath = filepath.Join(fullpath, fn)
-			f, err := os.Create(fullpath)
-			if err != nil {
-				u.dlError("Error creating file %s: %s", fullpath, err)
-				return
-			}
-			defer f.Close()
-			total := resp.ContentLength
-			dl := int64(0)
-			log.Printf("Starting remote download: %s => %s", task.link, fullpath)
-			for {
-				n, err := io.CopyN(f, resp.Body, 1024*1024*10)
-				dl += n
-				if err != nil {
-					u.broker.Broadcast(events.Packet{Type: events.DOWNLOAD_UPDATE, Data: downloadProgress{}})
-					if err == io.EOF {
-						u.dlSuccess("File %s downloaded", fn)
-						u.m <- metrics.MetricUpdate{Type: metrics.UPLOAD_COUNT, Value: 1}
-						u.m <- metrics.MetricUpdate{Type: metrics.UPLOAD_SIZE, Value: float64(dl)}
-						go func() {
-							err := u.civitdl.UpdateFile(f.Name())
-							if err != nil {
-								log.Printf("Error getting metadata from CivitAI: %s", err)
-							}
-						}()
-					} else {
-						u.dlError("Error during download: %s", err)
-						defer os.Remove(fullpath)
-					}
-					return
-				}
-				u.broker.Broadcast(events.Packet{Type: events.DOWNLOAD_UPDATE, Data: downloadProgress{Filename: fn, TotalBytes: total, CompletedBytes: dl}})
-			}
-		}()
+// runDownload downloads the job file and returns its size
+func (u *uploader) runDownload(ctx context.Context, job *downloadJob) (int64, error) {
+	cat := u.categoryByName(job.Category)
+	if cat == nil {
+		return 0, fmt.Errorf("unknown category %s", job.Category)
+	}
+	src := u.sourceByName(job.Source)
+	if src == nil {
+		return 0, fmt.Errorf("download source %s is disabled", job.Source)
+	}
+	req, err := http.NewRequestWithContext(ctx, "GET", job.Link, nil)
+	if err != nil {
+		return 0, fmt.Errorf("error making request: %w", err)
+	}
+	src.authorize(req)
+	resp, err := u.dlclient.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	if (resp.StatusCode == http.StatusUnauthorized || resp.StatusCode == http.StatusForbidden) && req.Header.Get(echo.HeaderAuthorization) != "" {
+		// the API key is rejected, try the cookie or anonymous access
+		resp.Body.Close()
+		log.Printf("%s rejected the API key, retrying without it", job.Source)
+		req.Header.Del(echo.HeaderAuthorization)
+		if resp, err = u.dlclient.Do(req); err != nil {
+			return 0, err
+		}
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return 0, fmt.Errorf("server returned code %d", resp.StatusCode)
+	}
+	fn := job.Filename
+	disp := resp.Header.Get(echo.HeaderContentDisposition)
+	if _, params, err := mime.ParseMediaType(disp); err == nil && params["filename"] != "" {
+		fn = filepath.Base(params["filename"])
+	} else if fn == "" {
+		return 0, fmt.Errorf("error parsing disposition (check if you can download the file in incognito), disposition: '%s': %v", disp, err)
+	}
+	fullpath, err := cat.fullPath(job.Dir)
+	if err != nil {
+		return 0, fmt.Errorf("invalid directory %s: %w", job.Dir, err)
+	}
+	if err := cat.validateFilename(fn); err != nil {
+		return 0, fmt.Errorf("invalid filename %s: %w", fn, err)
+	}
+	if cat.tooBig(resp.ContentLength) {
+		return 0, fmt.Errorf("file %s is too big", fn)
 	}
+	fullpath = filepath.Join(fullpath, fn)
+	if !job.Replace && exists(fullpath) {
+		return 0, fmt.Errorf("file %s already exists", fn)
+	}
+	if exists(fullpath) && !job.Admin && !cat.ownedBy(fullpath, job.User) {
+		return 0, fmt.Errorf("file %s belongs to another user", fn)
+	}
+	owner := cat.ownerAfterWrite(fullpath, job.User)
+	// the content length can be unknown, the quota is checked again while downloading
+	quotaLeft, quotaName := cat.quotaLeft(job.Dir, job.User, fullpath)
+	if quotaLeft >= 0 && resp.ContentLength > quotaLeft {
+		return 0, quotaError(quotaName, quotaLeft)
+	}
+	total := resp.ContentLength
+	u.jobUpdate(u.queue.update(job, true, func(j *downloadJob) {
+		j.Filename = fn
+		j.TotalBytes = total
+	}))
+	f, err := cat.createTemp()
+	if err != nil {
+		return 0, fmt.Errorf("error creating file %s: %w", fullpath, err)
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+	h := sha256.New()
+	w := io.MultiWriter(f, h)
+	dl := int64(0)
+	log.Printf("Starting remote download: %s => %s", job.Link, fullpath)
+	for {
+		n, err := io.CopyN(w, resp.Body, 1024*1024*10)
+		dl += n
+		if err == nil && cat.tooBig(dl) {
+			err = fmt.Errorf("file is bigger than %d bytes", cat.MaxSize)
+		}
+		if err == nil && quotaLeft >= 0 && dl > quotaLeft {
+			err = quotaError(quotaName, quotaLeft)
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return dl, err
+		}
+		u.jobUpdate(u.queue.update(job, false, func(j *downloadJob) { j.CompletedBytes = dl }))
+	}
+	sum := hex.EncodeToString(h.Sum(nil))
+	if err := finishDownload(f, fullpath, sum, job); err != nil {
+		return dl, err
+	}
+	cat.recordFile(fullpath, fileInfo{Owner: owner, Source: job.Source, URL: job.URL, SHA256: sum})
+	u.queue.update(job, false, func(j *downloadJob) { j.CompletedBytes = dl })
+	return dl, nil
 }
 
+func (u *uploader) downloadComplete(job downloadJob, size int64) {
+	u.m <- metrics.MetricUpdate{Type: metrics.UPLOAD_COUNT, Value: 1}
+	u.m <- metrics.MetricUpdate{Type: metrics.UPLOAD_SIZE, Value: float64(size)}
+	cat := u.categoryByName(job.Category)
+	fullpath, err := cat.fullPath(job.Dir)
+	if err != nil {
+		return
+	}
+	go func() {
+		err := u.civitdl.UpdateFile(filepath.Join(fullpath, job.Filename))
+		if err != nil {
+			log.Printf("Error getting metadata from CivitAI: %s", err)
+		}
+	}()
+}
+
+// finishDownload verifies the downloaded file and moves it into place
+func finishDownload(f *os.File, target string, sum string, job *downloadJob) error {
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if job.SHA256 != "" && sum != job.SHA256 {
+		return fmt.Errorf("checksum mismatch: expected %s, got %s", job.SHA256, sum)
+	}
+	if err := validateModel(f.Name(), target); err != nil {
+		return err
+	}
+	return placeFile(f.Name(), target, job.Replace)
+}
+
+// cookieRefresher keeps the browser session alive
 func (u *uploader) cookieRefresher() {
-	civiturl, _ := url.Parse("https://civitai.com")
+	civiturl, _ := url.Parse(u.civitai.BaseURL())
 	for {
-		req, _ := http.NewRequest("GET", "https://civitai.com/api/trpc/user.checkNotifications", nil)
-		req.Header.Add("Referer", "https://civitai.com/models")
+		req, _ := http.NewRequest("GET", u.civitai.BaseURL()+"/api/trpc/user.checkNotifications", nil)
+		req.Header.Add("Referer", u.civitai.BaseURL()+"/models")
 		_, err := u.dlclient.Do(req)
 		if err != nil {
 			log.Printf("Error refreshing cookie: %s", err)
@@ -389,7 +536,7 @@ func (u *uploader) loadCookies() {
 	if err != nil {
 		log.Printf("Error reading cookie file")
 	}
-	civiturl, _ := url.Parse("https://civitai.com")
+	civiturl, _ := url.Parse(u.civitai.BaseURL())
 	u.dlclient.Jar.SetCookies(civiturl, []*http.Cookie{{Name: civitaiToken, Value: string(token)}})
 }
 
@@ -399,13 +546,17 @@ func (u *uploader) downloadFile(c echo.Context) error {
 		log.Printf("Error unescaping path: %s", err)
 		return c.String(400, "Bad request")
 	}
+	cat, err := u.category(c)
+	if err != nil {
+		return c.String(403, "Forbidden")
+	}
 	if !filepath.IsLocal(file) {
 		return c.String(400, "Bad request")
 	}
-	if filepath.Ext(file) != ".safetensors" {
+	if cat.modelExt(file) == "" {
 		return c.String(400, "Bad request")
 	}
-	f, err := os.Open(filepath.Join(u.root, file))
+	f, err := os.Open(filepath.Join(cat.Root, file))
 	if err != nil {
 		log.Printf("Error opening file: %s", err)
 		return c.String(404, "Not found")
@@ -422,18 +573,61 @@ func (u *uploader) downloadFile(c echo.Context) error {
 	return nil
 }
 
-func NewUploader(api *echo.Group, rootPath string, cookieFile string, broker *events.Broker, m chan<- metrics.MetricUpdate) *uploader {
-	os.MkdirAll(rootPath, 0755)
-	result := uploader{root: rootPath, broker: broker, dlc: make(chan dlTask), cookieFile: cookieFile, civitdl: civitai.NewDownloader(), m: m}
-	result.pageclient.Timeout = time.Second * 30
+func NewUploader(api *echo.Group, cfg Config, broker *events.Broker, m chan<- metrics.MetricUpdate) *uploader {
+	categories := slices.Clone(cfg.Categories)
+	for i := range categories {
+		os.MkdirAll(categories[i].stagingPath(), 0755)
+		categories[i].migrateTrash()
+		categories[i].index = loadFileIndex(filepath.Join(categories[i].stagingPath(), "index.json"))
+		categories[i].search = newSearchIndex(&categories[i])
+		go categories[i].search.watch()
+	}
+	result := uploader{categories: categories, user: cfg.User, hasRole: cfg.HasRole, broker: broker, queue: newDownloadQueue(queueFile(categories)), cookieFile: cfg.CookieFile,
+		civitai: cfg.CivitAI, m: m, activeChunks: map[string]struct{}{}}
+	if result.user == nil {
+		result.user = func(c echo.Context) string { return "" }
+	}
+	if result.civitai == nil {
+		result.civitai = civitai.NewClient(civitai.ClientConfig{Token: cfg.Sources.CivitAI.Token, BaseURL: cfg.Sources.CivitAI.BaseURL})
+	}
+	result.civitdl = civitai.NewDownloader(result.civitai)
+	result.sources = newSources(cfg.Sources, result.civitai)
+	result.adminRole = cfg.AdminRole
+	result.trashRetention = cfg.Retention
+	if len(cfg.BaseModels) > 0 {
+		result.civitdl.BaseModels = cfg.BaseModels
+	}
+	result.civitdl.Previews = cfg.Previews
+	// the cookie is the fallback if the API key is rejected
 	result.loadCookies()
 	go result.cookieRefresher()
 	api.StaticFS("*", echo.MustSubFS(webroot, "webroot"))
+	api.GET("/categories", result.listCategories)
 	api.GET("/files", result.listFiles)
+	api.GET("/search", result.search)
 	api.GET("/stat", result.stat)
+	api.GET("/disk", result.disk)
 	api.POST("/files", result.postFiles)
 	api.POST("/download", result.download)
+	api.GET("/download/preview", result.downloadPreview)
 	api.GET("/download/:file", result.downloadFile)
-	go result.startDownloader()
+	api.GET("/civitai/health", result.civitaiHealth)
+	api.POST("/chunked", result.createChunked)
+	api.GET("/chunked/:id", result.chunkedStatus)
+	api.HEAD("/chunked/:id", result.chunkedStatus)
+	api.PUT("/chunked/:id", result.putChunk)
+	api.DELETE("/chunked/:id", result.deleteChunked)
+	api.GET("/trash", result.listTrash)
+	api.POST("/trash/:id/restore", result.restoreTrash)
+	api.DELETE("/trash/:id", result.purgeTrash)
+	api.GET("/downloads", result.listDownloads)
+	api.POST("/downloads/:id/cancel", result.cancelDownload)
+	api.POST("/downloads/:id/retry", result.retryDownload)
+	api.DELETE("/downloads/:id", result.removeDownload)
+	for range max(cfg.Workers, 1) {
+		go result.downloadWorker()
+	}
+	go result.stagingCleaner()
+	go result.trashCleaner()
 	return &result
 }
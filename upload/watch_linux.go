@@ -0,0 +1,135 @@
+package upload
+
+import (
+	"io/fs"
+	"log"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+const (
+	watchDebounce = time.Second
+	watchMask     = unix.IN_CREATE | unix.IN_CLOSE_WRITE | unix.IN_DELETE | unix.IN_MOVED_FROM | unix.IN_MOVED_TO |
+		unix.IN_ATTRIB
+)
+
+// watcher maps the inotify watch descriptors to the watched directories
+type watcher struct {
+	fd   int
+	dirs map[int]string
+}
+
+// addTree watches the directory and its subdirectories except the hidden ones
+func (w *watcher) addTree(root string) {
+	filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || !d.IsDir() {
+			return nil
+		}
+		if strings.HasPrefix(d.Name(), ".") && path != root {
+			return filepath.SkipDir
+		}
+		wd, err := unix.InotifyAddWatch(w.fd, path, watchMask)
+		if err != nil {
+			log.Printf("Error watching %s: %s", path, err)
+			return nil
+		}
+		w.dirs[wd] = path
+		return nil
+	})
+}
+
+// removeTree stops watching the directory that was moved away
+func (w *watcher) removeTree(root string) {
+	for wd, path := range w.dirs {
+		if path == root || strings.HasPrefix(path, root+string(filepath.Separator)) {
+			unix.InotifyRmWatch(w.fd, uint32(wd))
+			delete(w.dirs, wd)
+		}
+	}
+}
+
+// watch builds the index and keeps it up to date using inotify, the changed paths are collected for a short time
+// and then reindexed together
+func (idx *searchIndex) watch() {
+	fd, err := unix.InotifyInit1(unix.IN_CLOEXEC)
+	if err != nil {
+		log.Printf("Error initializing inotify, falling back to polling: %s", err)
+		idx.poll()
+		return
+	}
+	w := &watcher{fd: fd, dirs: map[int]string{}}
+	w.addTree(idx.cat.Root)
+	idx.rebuild()
+	var lock sync.Mutex
+	dirty := map[string]struct{}{}
+	flush := func() {
+		lock.Lock()
+		paths := dirty
+		dirty = map[string]struct{}{}
+		lock.Unlock()
+		if _, ok := paths[idx.cat.Root]; ok {
+			idx.rebuild()
+			return
+		}
+		for p := range paths {
+			idx.update(p)
+		}
+	}
+	markDirty := func(path string) {
+		lock.Lock()
+		defer lock.Unlock()
+		if len(dirty) == 0 {
+			time.AfterFunc(watchDebounce, flush)
+		}
+		dirty[path] = struct{}{}
+	}
+	buf := make([]byte, 64*1024)
+	for {
+		n, err := unix.Read(fd, buf)
+		if err == unix.EINTR {
+			continue
+		}
+		if err != nil {
+			log.Printf("Error reading inotify events, falling back to polling: %s", err)
+			unix.Close(fd)
+			idx.poll()
+			return
+		}
+		for offset := 0; offset+unix.SizeofInotifyEvent <= n; {
+			event := (*unix.InotifyEvent)(unsafe.Pointer(&buf[offset]))
+			nameBytes := buf[offset+unix.SizeofInotifyEvent : offset+unix.SizeofInotifyEvent+int(event.Len)]
+			offset += unix.SizeofInotifyEvent + int(event.Len)
+			if event.Mask&unix.IN_Q_OVERFLOW != 0 {
+				markDirty(idx.cat.Root)
+				continue
+			}
+			if event.Mask&unix.IN_IGNORED != 0 {
+				delete(w.dirs, int(event.Wd))
+				continue
+			}
+			dir, ok := w.dirs[int(event.Wd)]
+			if !ok {
+				continue
+			}
+			name := strings.TrimRight(string(nameBytes), "\x00")
+			if name == "" || strings.HasPrefix(name, ".") {
+				continue
+			}
+			path := filepath.Join(dir, name)
+			if event.Mask&unix.IN_ISDIR != 0 {
+				if event.Mask&unix.IN_MOVED_FROM != 0 {
+					w.removeTree(path)
+				}
+				if event.Mask&(unix.IN_CREATE|unix.IN_MOVED_TO) != 0 {
+					w.addTree(path)
+				}
+			}
+			markDirty(path)
+		}
+	}
+}
@@ -0,0 +1,6 @@
+package upload
+
+// watch builds the index and rescans the category periodically
+func (idx *searchIndex) watch() {
+	idx.poll()
+}
@@ -1,4 +1,9 @@
 let sort = JSON.parse(localStorage.getItem('upload_sort') ?? '["name", "asc"]');
+let categories = [];
+let category = localStorage.getItem('upload_category') ?? '';
+let mine = localStorage.getItem('upload_mine') === 'true';
+let searchTimer = null;
+let searchPage = 1;
 
 function getCurrentPath() {
     let currentPath = decodeURI(location.hash);
@@ -15,6 +20,54 @@ async function alertError(result) {
     alert('Error: ' + (await result.json()).message);
 }
 
+function currentCategory() {
+    return categories.find((c) => c.name === category) ?? categories[0];
+}
+
+async function loadCategories() {
+    const result = await fetch('categories');
+    if (result.status != 200) {
+        alertError(result);
+        return;
+    }
+    categories = await result.json();
+    if (!categories.length) {
+        alert('Error: no upload categories available');
+        return;
+    }
+    category = currentCategory().name;
+    const select = document.getElementById('category');
+    select.innerHTML = '';
+    for (const c of categories) {
+        const opt = document.createElement('option');
+        opt.value = c.name;
+        opt.innerText = c.title;
+        select.append(opt);
+    }
+    select.value = category;
+    select.style.display = categories.length > 1 ? '' : 'none';
+    document.getElementById('mine').checked = mine;
+    loadBaseModels();
+    load();
+}
+
+function setCategory(name) {
+    category = name;
+    localStorage.setItem('upload_category', name);
+    loadBaseModels();
+    if (location.hash) {
+        location.hash = '';
+    } else {
+        load();
+    }
+}
+
+function setMine(value) {
+    mine = value;
+    localStorage.setItem('upload_mine', value);
+    load();
+}
+
 function setSort(col) {
     if (sort[0] === col) {
         sort[1] = sort[1] === 'asc' ? 'desc' : 'asc';
@@ -33,6 +86,10 @@ function formatSort(col) {
 }
 
 async function load() {
+    if (searchParams()) {
+        search(searchPage);
+        return;
+    }
     let uplink = '';
     let currentPath = getCurrentPath();
     if (currentPath) {
@@ -46,12 +103,18 @@ async function load() {
         </a><div>`;
     }
     document.getElementById('path').innerText = currentPath;
-    const result = await fetch('files?dir=' + encodeURIComponent(currentPath));
+    const result = await fetch(
+        'files?dir=' +
+            encodeURIComponent(currentPath) +
+            '&category=' +
+            encodeURIComponent(category) +
+            (mine ? '&mine=true' : '')
+    );
     if (result.status != 200) {
         alertError(result);
         return;
     }
-    fetch('stat')
+    fetch('stat?category=' + encodeURIComponent(category))
         .then((r) => r.json())
         .then((j) => {
             document.getElementById('stat').innerHTML = `Free space: ${j.free}`;
@@ -69,7 +132,7 @@ async function load() {
         'name'
     )}</th><th onclick="setSort('timestamp')" class="clickable">Upload date ${formatSort(
         'timestamp'
-    )}</th></tr></thead>`;
+    )}</th><th>Added by</th><th></th></tr></thead>`;
     files.append(fileList);
     const fileListBody = document.createElement('tbody');
     fileList.append(fileListBody);
@@ -96,25 +159,376 @@ async function load() {
         const row = document.createElement('tr');
         fileListBody.append(row);
         if (file.type === 'dir') {
-            row.innerHTML = `<td colspan="2">
+            row.innerHTML = `<td colspan="3">
             <a href='#${encodeURI(currentPath + file.name)}'>
                 <img src='images/folder.png' class='icon' />
                 ${file.name}
             </a>
         </td>`;
+            row.append(
+                entryActions(unescapeHTML(file.name), '', file.can_modify)
+            );
         } else {
             row.innerHTML += `<td valign="middle">
             <a href="download/${encodeURIComponent(
                 currentPath.replace(/\/$/, '')
-            )}/${encodeURIComponent(file.name)}.safetensors">
+            )}/${encodeURIComponent(
+                file.name + file.ext
+            )}?category=${encodeURIComponent(category)}">
             <span class="filename"><img src="images/file.png" class="icon" /> ${
                 file.name
             }</span></a></td>
             <td>${new Date(file.timestamp).toLocaleString()}</td>`;
+            row.append(
+                ownerCell(file.info),
+                entryActions(unescapeHTML(file.name), file.ext, file.can_modify)
+            );
         }
     }
 }
 
+function searchParams() {
+    const q = document.getElementById('search').value.trim();
+    const baseModel = document.getElementById('basemodel').value;
+    if (!q && !baseModel) {
+        return null;
+    }
+    const result = new URLSearchParams({
+        category,
+        q,
+        base_model: baseModel,
+        sort: sort[0] === 'timestamp' ? 'modified' : 'name',
+        order: sort[1],
+    });
+    if (mine) {
+        result.set('mine', 'true');
+    }
+    return result;
+}
+
+function scheduleSearch() {
+    clearTimeout(searchTimer);
+    searchTimer = setTimeout(() => search(1), 300);
+}
+
+function clearSearch() {
+    document.getElementById('search').value = '';
+    document.getElementById('basemodel').value = '';
+}
+
+async function loadBaseModels() {
+    const result = await fetch(
+        'search?' + new URLSearchParams({ category, per_page: 1 })
+    );
+    if (result.status != 200) {
+        return;
+    }
+    const select = document.getElementById('basemodel');
+    const current = select.value;
+    select.innerHTML = '<option value="">Any base model</option>';
+    for (const bm of (await result.json()).base_models) {
+        const opt = document.createElement('option');
+        opt.value = bm;
+        opt.innerText = bm;
+        select.append(opt);
+    }
+    select.value = current;
+}
+
+async function search(page) {
+    const params = searchParams();
+    if (!params) {
+        load();
+        return;
+    }
+    searchPage = page;
+    params.set('page', page);
+    const result = await fetch('search?' + params);
+    if (result.status != 200) {
+        alertError(result);
+        return;
+    }
+    const j = await result.json();
+    document.getElementById('path').innerText = 'Search results';
+    const files = document.getElementById('files');
+    files.innerHTML = '';
+    if (!j.ready) {
+        files.innerHTML = '<div>Indexing models, try again later</div>';
+        return;
+    }
+    if (!j.items.length) {
+        files.innerHTML = '<div>Nothing found</div>';
+        return;
+    }
+    const fileList = document.createElement('table');
+    fileList.setAttribute('cellpadding', 5);
+    fileList.innerHTML = `<thead><tr><th onclick="setSort('name')" class="clickable">Filename ${formatSort(
+        'name'
+    )}</th><th>Base model</th><th onclick="setSort('timestamp')" class="clickable">Upload date ${formatSort(
+        'timestamp'
+    )}</th></tr></thead>`;
+    const body = document.createElement('tbody');
+    fileList.append(body);
+    for (const item of j.items) {
+        const row = document.createElement('tr');
+        const name = document.createElement('td');
+        const link = document.createElement('a');
+        link.href = `download/${encodeURIComponent(
+            item.path
+        )}?category=${encodeURIComponent(category)}`;
+        link.innerHTML = '<img src="images/file.png" class="icon" /> ';
+        link.append(item.name);
+        link.title = [item.description, item.trigger_words?.join(', ')]
+            .filter(Boolean)
+            .join('\n');
+        const dir = document.createElement('a');
+        dir.href = '#' + encodeURI(item.dir);
+        dir.className = 'search-dir';
+        dir.innerText = '/' + item.dir;
+        dir.onclick = clearSearch;
+        name.append(link, dir);
+        const baseModel = document.createElement('td');
+        baseModel.innerText = item.base_model ?? '';
+        const date = document.createElement('td');
+        date.innerText = new Date(item.modified).toLocaleString();
+        row.append(name, baseModel, date);
+        body.append(row);
+    }
+    files.append(fileList);
+    const pages = Math.ceil(j.total / j.per_page);
+    if (pages > 1) {
+        const pager = document.createElement('div');
+        pager.className = 'pager';
+        pager.innerHTML = `<button class="button-3 button-4" ${
+            page > 1 ? '' : 'disabled'
+        } onclick="search(${page - 1})">&lt;</button> ${page} / ${pages}
+        <button class="button-3 button-4" ${
+            page < pages ? '' : 'disabled'
+        } onclick="search(${page + 1})">&gt;</button>`;
+        files.append(pager);
+    }
+}
+
+// the names are HTML-escaped by the server
+function unescapeHTML(s) {
+    return new DOMParser().parseFromString(s, 'text/html').documentElement
+        .textContent;
+}
+
+function ownerCell(info) {
+    const td = document.createElement('td');
+    td.className = 'owner';
+    if (!info) {
+        return td;
+    }
+    td.innerText = info.owner || '—';
+    td.title = [info.source, info.url, info.sha256 && 'SHA256: ' + info.sha256]
+        .filter(Boolean)
+        .join('\n');
+    return td;
+}
+
+function entryActions(name, ext, canModify) {
+    const td = document.createElement('td');
+    td.className = 'actions';
+    if (!canModify) {
+        return td;
+    }
+    for (const [title, icon, action] of [
+        ['Rename', '&#9998;', renameEntry],
+        ['Move', '&#128194;', moveToDir],
+        ['Delete', '&#128465;', deleteEntry],
+    ]) {
+        const btn = document.createElement('span');
+        btn.className = 'clickable';
+        btn.title = title;
+        btn.innerHTML = icon;
+        btn.onclick = () => action(name, ext);
+        td.append(btn);
+    }
+    return td;
+}
+
+async function fileAction(data) {
+    data.append('category', category);
+    const result = await fetch('files', { method: 'POST', body: data });
+    if (result.status != 200) {
+        alertError(result);
+        return null;
+    }
+    load();
+    return result.json();
+}
+
+async function moveEntry(path, target, undo) {
+    const data = new FormData();
+    data.append('type', 'move');
+    data.append('path', path);
+    data.append('target', target);
+    if ((await fileAction(data)) && undo) {
+        toast(`Moved to ${target}, click to undo`, 'success', () =>
+            moveEntry(target, path, false)
+        );
+    }
+}
+
+async function renameEntry(name, ext) {
+    const currentPath = getCurrentPath();
+    const newName = prompt('Enter new name', name);
+    if (!newName || newName === name) {
+        return;
+    }
+    await moveEntry(currentPath + name + ext, currentPath + newName + ext, true);
+}
+
+async function moveToDir(name, ext) {
+    const currentPath = getCurrentPath();
+    const dir = prompt('Enter target directory (empty for root)', currentPath);
+    if (dir === null) {
+        return;
+    }
+    const target = dir.replace(/^\/+|\/+$/g, '');
+    await moveEntry(
+        currentPath + name + ext,
+        (target ? target + '/' : '') + name + ext,
+        true
+    );
+}
+
+async function deleteEntry(name, ext) {
+    const path = getCurrentPath() + name + ext;
+    if (!window.confirm(`Delete ${path}?`)) {
+        return;
+    }
+    const data = new FormData();
+    data.append('type', 'delete');
+    data.append('path', path);
+    const entry = await fileAction(data);
+    if (entry) {
+        toast(`${path} moved to trash, click to undo`, 'success', () =>
+            restoreTrash(entry.id)
+        );
+    }
+}
+
+async function restoreTrash(id) {
+    const result = await fetch(
+        `trash/${id}/restore?category=${encodeURIComponent(category)}`,
+        { method: 'POST' }
+    );
+    if (result.status != 200) {
+        alertError(result);
+        return;
+    }
+    load();
+    if (document.getElementById('trash').open) {
+        showTrash();
+    }
+}
+
+async function showTrash() {
+    const result = await fetch(
+        'trash?category=' + encodeURIComponent(category)
+    );
+    if (result.status != 200) {
+        alertError(result);
+        return;
+    }
+    const entries = await result.json();
+    const list = document.getElementById('trashlist');
+    list.innerHTML = entries.length ? '' : '<div>Empty</div>';
+    for (const e of entries) {
+        const row = document.createElement('div');
+        row.className = 'trash-entry';
+        const name = document.createElement('span');
+        name.innerText = `${e.path} (${new Date(e.deleted).toLocaleString()})`;
+        const btn = document.createElement('button');
+        btn.className = 'button-3';
+        btn.innerText = 'Restore';
+        btn.onclick = () => restoreTrash(e.id);
+        row.append(name, btn);
+        list.append(row);
+    }
+    const dialog = document.getElementById('trash');
+    if (!dialog.open) {
+        dialog.showModal();
+    }
+}
+
+function formatQuota(size, quota) {
+    return quota
+        ? `${formatSize(size)} of ${formatSize(quota)}`
+        : formatSize(size);
+}
+
+function diskSection(title, rows) {
+    const section = document.createElement('div');
+    const header = document.createElement('h4');
+    header.innerText = title;
+    section.append(header);
+    if (!rows.length) {
+        section.append('None');
+    }
+    for (const [name, value] of rows) {
+        const row = document.createElement('div');
+        row.className = 'trash-entry';
+        const label = document.createElement('span');
+        label.innerText = name;
+        const size = document.createElement('span');
+        size.innerText = value;
+        row.append(label, size);
+        section.append(row);
+    }
+    return section;
+}
+
+async function showDisk() {
+    const result = await fetch(
+        'disk?category=' + encodeURIComponent(category)
+    );
+    if (result.status != 200) {
+        alertError(result);
+        return;
+    }
+    const r = await result.json();
+    const report = document.getElementById('diskreport');
+    report.innerHTML = '';
+    report.append(
+        diskSection('Summary', [
+            ['Used by models', formatSize(r.used)],
+            ['Trash', formatSize(r.trash)],
+            ['Free', `${formatSize(r.free)} of ${formatSize(r.total)}`],
+        ]),
+        diskSection(
+            'Directories',
+            r.dirs.map((d) => [
+                `/${d.path} (${d.files} files)`,
+                formatQuota(d.size, d.quota),
+            ])
+        ),
+        diskSection(
+            'Users',
+            r.users.map((u) => [
+                `${u.user} (${u.files} models)`,
+                formatQuota(u.size, u.quota),
+            ])
+        ),
+        diskSection(
+            'Largest models',
+            r.largest.map((f) => [f.path, formatSize(f.size)])
+        ),
+        diskSection(
+            'Duplicates' +
+                (r.unhashed ? ` (${r.unhashed} models not hashed yet)` : ''),
+            r.duplicates.map((g) => [g.paths.join(', '), formatSize(g.size)])
+        )
+    );
+    const dialog = document.getElementById('disk');
+    if (!dialog.open) {
+        dialog.showModal();
+    }
+}
+
 async function createDir() {
     const dirName = prompt('Enter new dir name');
     if (!dirName) {
@@ -124,6 +538,7 @@ async function createDir() {
     const data = new FormData();
     data.append('dir', currentPath + dirName);
     data.append('type', 'create_dir');
+    data.append('category', category);
     const result = await fetch('files', { method: 'POST', body: data });
     if (result.status != 200) {
         alertError(result);
@@ -132,10 +547,131 @@ async function createDir() {
     load();
 }
 
+const chunkSize = 8 * 1024 * 1024;
+const maxRetries = 10;
+
+function chunkedURL(id, params) {
+    return `chunked/${id}?` + new URLSearchParams({ category, ...params });
+}
+
+function sleep(ms) {
+    return new Promise((resolve) => setTimeout(resolve, ms));
+}
+
+// startChunked resumes the previous upload of the same file or creates a new one
+async function startChunked(file, currentPath, key) {
+    const saved = localStorage.getItem(key);
+    if (saved) {
+        const result = await fetch(chunkedURL(saved));
+        if (result.status === 200) {
+            return [saved, (await result.json()).offset];
+        }
+        localStorage.removeItem(key);
+    }
+    const data = new FormData();
+    data.append('category', category);
+    data.append('dir', currentPath);
+    data.append('filename', file.name);
+    data.append('size', file.size);
+    let result = await fetch('chunked', { method: 'POST', body: data });
+    if (
+        result.status === 409 &&
+        window.confirm(`${file.name} already exists, replace it?`)
+    ) {
+        data.append('replace', 'true');
+        result = await fetch('chunked', { method: 'POST', body: data });
+    }
+    if (result.status !== 200) {
+        throw new Error((await result.json()).message);
+    }
+    const id = (await result.json()).id;
+    localStorage.setItem(key, id);
+    return [id, 0];
+}
+
+async function uploadChunked(file, signal, setProgress) {
+    const currentPath = getCurrentPath();
+    const key = `upload_chunked_${category}_${currentPath}${file.name}_${file.size}_${file.lastModified}`;
+    let [id, offset] = await startChunked(file, currentPath, key);
+    let hasher = new SHA256();
+    let hashed = 0;
+    // hashTo feeds the file up to the position to the hasher, resumed uploads rehash the uploaded part
+    const hashTo = async (pos) => {
+        if (pos < hashed) {
+            hasher = new SHA256();
+            hashed = 0;
+        }
+        while (hashed < pos) {
+            const end = Math.min(pos, hashed + chunkSize);
+            hasher.update(
+                new Uint8Array(await file.slice(hashed, end).arrayBuffer())
+            );
+            hashed = end;
+            setProgress(hashed, file.size, 'Verifying');
+        }
+    };
+    await hashTo(offset);
+    let retries = 0;
+    for (;;) {
+        const end = Math.min(file.size, offset + chunkSize);
+        const chunk = new Uint8Array(await file.slice(offset, end).arrayBuffer());
+        await hashTo(offset);
+        const params = { offset };
+        if (end === file.size) {
+            hasher.update(chunk);
+            hashed = end;
+            params.sha256 = hasher.hex(); // finalizes the hasher, retries rehash the file
+        }
+        let result;
+        try {
+            result = await fetch(chunkedURL(id, params), {
+                method: 'PUT',
+                body: chunk,
+                signal,
+            });
+        } catch (e) {
+            if (signal.aborted || ++retries > maxRetries) {
+                throw e;
+            }
+            await sleep(3000);
+            const status = await fetch(chunkedURL(id)).catch(() => null);
+            if (status?.status === 200) {
+                offset = (await status.json()).offset;
+            }
+            continue;
+        }
+        const j = await result.json().catch(() => ({}));
+        if (result.status === 409 && j.offset !== undefined) {
+            offset = j.offset;
+            continue;
+        }
+        if (result.status >= 500 && ++retries <= maxRetries) {
+            await sleep(3000);
+            offset = j.offset ?? offset;
+            continue;
+        }
+        if (result.status !== 200) {
+            localStorage.removeItem(key);
+            throw new Error(j.message);
+        }
+        retries = 0;
+        if (j.offset === end && hashed === offset) {
+            hasher.update(chunk);
+            hashed = end;
+        }
+        offset = j.offset;
+        setProgress(offset, file.size, 'Uploading');
+        if (j.complete) {
+            localStorage.removeItem(key);
+            return;
+        }
+    }
+}
+
 async function uploadFile() {
     const inp = document.createElement('input');
     inp.type = 'file';
-    inp.accept = '.safetensors';
+    inp.accept = currentCategory().extensions.join(',');
     inp.onchange = async function () {
         const loading = document.createElement('div');
         loading.setAttribute('class', 'loading');
@@ -144,69 +680,156 @@ async function uploadFile() {
         document.body.appendChild(loading);
         const progress = document.getElementById('progress');
         const abortBtn = document.getElementById('abort-btn');
+        const controller = new AbortController();
+        abortBtn.onclick = () => {
+            if (
+                window.confirm(
+                    'Abort upload? Select the same file again later to resume.'
+                )
+            ) {
+                controller.abort();
+            }
+        };
         try {
-            let currentPath = getCurrentPath();
-            const data = new FormData();
-            data.append('dir', currentPath);
-            data.append('file', inp.files[0]);
-            data.append('type', 'upload_file');
-            const req = new XMLHttpRequest();
-            req.upload.addEventListener('progress', function (ev) {
-                if (ev.total > 0) {
-                    const perc =
-                        ((ev.loaded * 100) / ev.total).toFixed(2) + '%';
+            await uploadChunked(
+                inp.files[0],
+                controller.signal,
+                (done, total, stage) => {
+                    const perc = ((done * 100) / total).toFixed(2) + '%';
                     progress.style.setProperty('width', perc);
-                    progress.innerText = perc;
-                }
-            });
-            req.addEventListener('readystatechange', (ev) => {
-                if (req.readyState === XMLHttpRequest.DONE) {
-                    document.body.removeChild(loading);
-                    load();
-                    if (req.status !== 200 && req.status !== 0) {
-                        try {
-                            alert('Error: ' + JSON.parse(req.response).message);
-                        } catch {
-                            alert('Error: ' + req.statusText);
-                        }
-                    }
+                    progress.innerText = `${stage} ${perc}`;
                 }
-            });
-            abortBtn.onclick = () => {
-                if (window.confirm('Abort upload?')) {
-                    req.abort();
-                }
-            };
-            const error = () => {
-                alert('Error during file upload');
-            };
-            req.addEventListener('error', error);
-            req.open('POST', 'files');
-            req.send(data);
+            );
+        } catch (e) {
+            if (!controller.signal.aborted) {
+                alert('Error: ' + e.message);
+            }
         } finally {
+            document.body.removeChild(loading);
+            load();
         }
     };
     inp.click();
 }
 
+function formatSize(bytes) {
+    const units = ['B', 'KB', 'MB', 'GB', 'TB'];
+    let i = 0;
+    while (bytes >= 1024 && i < units.length - 1) {
+        bytes /= 1024;
+        i++;
+    }
+    return `${bytes.toFixed(i ? 2 : 0)} ${units[i]}`;
+}
+
 async function downloadFile() {
     const input = document.getElementById('civiturl');
     const url = input.value;
-    if (!window.confirm(`Load a LoRA remotely from ${url}?`)) {
+    const result = await fetch(
+        'download/preview?' + new URLSearchParams({ url, category })
+    );
+    if (result.status != 200) {
+        alertError(result);
+        return;
+    }
+    const preview = await result.json();
+    if (preview.error) {
+        alert('Error: ' + preview.error);
+        return;
+    }
+    if (preview.versions?.length) {
+        pickVersion(url, preview);
+        return;
+    }
+    const title = currentCategory().title;
+    if (
+        !window.confirm(
+            `Load ${preview.name || 'a ' + title} remotely from ${url}?`
+        )
+    ) {
         return;
     }
+    startDownload(url, {});
+}
+
+// pickVersion lets the user choose the model version and file before downloading
+function pickVersion(url, preview) {
+    const dialog = document.getElementById('dlpicker');
+    const versionSelect = document.getElementById('dlversion');
+    const fileSelect = document.getElementById('dlfile');
+    const info = document.getElementById('dlinfo');
+    document.getElementById('dlmodel').innerText = `${preview.name} (${preview.type})`;
+    versionSelect.innerHTML = '';
+    for (const v of preview.versions) {
+        const opt = document.createElement('option');
+        opt.value = v.id;
+        opt.innerText = `${v.name} [${v.base_model}]`;
+        versionSelect.append(opt);
+    }
+    const showVersion = () => {
+        const v = preview.versions.find((v) => v.id == versionSelect.value);
+        info.innerText = v.trained_words?.length
+            ? 'Trigger words: ' + v.trained_words.join(', ')
+            : '';
+        fileSelect.innerHTML = '';
+        let selected = null;
+        for (const f of v.files) {
+            const opt = document.createElement('option');
+            opt.value = f.id;
+            opt.disabled = !f.allowed;
+            opt.innerText = [
+                f.name,
+                f.type,
+                f.format,
+                f.fp,
+                f.model_size,
+                formatSize(f.size),
+            ]
+                .filter((x) => x)
+                .join(', ');
+            fileSelect.append(opt);
+            if (f.allowed && (selected === null || f.primary)) {
+                selected = f.id;
+            }
+        }
+        fileSelect.value = selected ?? '';
+    };
+    versionSelect.value = preview.selected || preview.versions[0].id;
+    versionSelect.onchange = showVersion;
+    showVersion();
+    document.getElementById('dlstart').onclick = () => {
+        if (!fileSelect.value) {
+            alert('No suitable files in this version');
+            return;
+        }
+        dialog.close();
+        startDownload(url, {
+            version_id: versionSelect.value,
+            file_id: fileSelect.value,
+        });
+    };
+    dialog.showModal();
+}
+
+function startDownload(url, choice) {
     const params = new FormData();
     params.append('url', url);
     params.append('dir', getCurrentPath());
+    params.append('category', category);
+    params.append('replace', document.getElementById('replace').checked);
+    for (const [k, v] of Object.entries(choice)) {
+        params.append(k, v);
+    }
     fetch('download', { method: 'POST', body: params });
-    input.value = '';
-    toast('LoRA queued, please wait!', 'success');
+    document.getElementById('civiturl').value = '';
+    toast(`${currentCategory().title} queued, please wait!`, 'success');
 }
 
-function toast(text, type) {
+function toast(text, type, onClick) {
     Toastify({
         text,
-        duration: 3000,
+        onClick,
+        duration: onClick ? 10000 : 3000,
         close: true,
         gravity: 'bottom',
         position: 'center',
@@ -227,12 +850,89 @@ function startWS() {
     init(ws);
 }
 
+const downloads = new Map();
+
+async function loadDownloads() {
+    const result = await fetch('downloads');
+    if (result.status != 200) {
+        return;
+    }
+    for (const job of await result.json()) {
+        downloads.set(job.id, job);
+    }
+    renderDownloads();
+}
+
+async function downloadAction(id, action) {
+    const result = await fetch(
+        action === 'remove' ? `downloads/${id}` : `downloads/${id}/${action}`,
+        { method: action === 'remove' ? 'DELETE' : 'POST' }
+    );
+    if (result.status >= 400) {
+        alertError(result);
+        return;
+    }
+    if (action === 'remove') {
+        downloads.delete(id);
+        renderDownloads();
+    }
+}
+
+function renderDownloads() {
+    const cont = document.getElementById('downloads');
+    cont.innerHTML = '';
+    for (const job of downloads.values()) {
+        const row = document.createElement('div');
+        row.className = 'dljob';
+        const name = document.createElement('div');
+        name.className = 'dlfilename';
+        name.innerText = `${job.filename || job.link} (${job.state})`;
+        row.append(name);
+        if (job.state === 'running' && job.total_bytes > 0) {
+            const perc =
+                ((job.completed_bytes * 100) / job.total_bytes).toFixed(2) + '%';
+            row.insertAdjacentHTML(
+                'beforeend',
+                `<div class="animated-progress progress-blue"><span style="width: ${perc}">${perc}</span></div>`
+            );
+        }
+        if (job.error) {
+            const err = document.createElement('div');
+            err.className = 'dlerror';
+            err.innerText = job.error;
+            row.append(err);
+        }
+        const actions = [];
+        if (job.state === 'queued' || job.state === 'running') {
+            actions.push(['cancel', 'Cancel']);
+        } else {
+            if (job.state !== 'done') {
+                actions.push(['retry', 'Retry']);
+            }
+            actions.push(['remove', 'Remove']);
+        }
+        const buttons = document.createElement('div');
+        for (const [action, title] of actions) {
+            const btn = document.createElement('button');
+            btn.className = 'button-3';
+            btn.innerText = title;
+            btn.onclick = () => downloadAction(job.id, action);
+            buttons.append(btn, ' ');
+        }
+        row.append(buttons);
+        cont.append(row);
+    }
+    if (downloads.size) {
+        cont.style.removeProperty('display');
+    } else {
+        cont.style.setProperty('display', 'none');
+    }
+}
+
 function init(ws) {
-    const cont = document.getElementById('dlcontainer');
-    const progress = document.getElementById('dlprogress');
-    const fn = document.getElementById('dlfilename');
     ws.onopen = () => {
         console.log('Connected!');
+        loadDownloads();
     };
     ws.onclose = (e) => {
         setTimeout(() => {
@@ -248,20 +948,21 @@ function init(ws) {
         const data = packet.data;
         switch (type) {
             case 'download':
-                if (data.filename) {
-                    cont.style.removeProperty('display');
-                    fn.innerText = data.filename;
-                } else {
-                    cont.style.setProperty('display', 'none');
-                    load();
+                if (!data.id) {
                     break;
                 }
-                const perc =
-                    ((data.completed_bytes * 100) / data.total_bytes).toFixed(
-                        2
-                    ) + '%';
-                progress.style.setProperty('width', perc);
-                progress.innerText = perc;
+                const prev = downloads.get(data.id);
+                if (prev?.state === data.state) {
+                    downloads.set(data.id, { ...prev, ...data });
+                    renderDownloads();
+                    break;
+                }
+                // only the progress is broadcast, the details of the accessible jobs are in the list
+                loadDownloads().then(() => {
+                    if (data.state === 'done' && downloads.has(data.id)) {
+                        load();
+                    }
+                });
                 break;
             case 'message':
                 toast(data.message, data.type);
@@ -0,0 +1,114 @@
+// Incremental SHA-256, crypto.subtle can only hash the whole buffer at once
+// which doesn't work for multi-gigabyte model files.
+class SHA256 {
+    static K = new Uint32Array([
+        0x428a2f98, 0x71374491, 0xb5c0fbcf, 0xe9b5dba5, 0x3956c25b, 0x59f111f1,
+        0x923f82a4, 0xab1c5ed5, 0xd807aa98, 0x12835b01, 0x243185be, 0x550c7dc3,
+        0x72be5d74, 0x80deb1fe, 0x9bdc06a7, 0xc19bf174, 0xe49b69c1, 0xefbe4786,
+        0x0fc19dc6, 0x240ca1cc, 0x2de92c6f, 0x4a7484aa, 0x5cb0a9dc, 0x76f988da,
+        0x983e5152, 0xa831c66d, 0xb00327c8, 0xbf597fc7, 0xc6e00bf3, 0xd5a79147,
+        0x06ca6351, 0x14292967, 0x27b70a85, 0x2e1b2138, 0x4d2c6dfc, 0x53380d13,
+        0x650a7354, 0x766a0abb, 0x81c2c92e, 0x92722c85, 0xa2bfe8a1, 0xa81a664b,
+        0xc24b8b70, 0xc76c51a3, 0xd192e819, 0xd6990624, 0xf40e3585, 0x106aa070,
+        0x19a4c116, 0x1e376c08, 0x2748774c, 0x34b0bcb5, 0x391c0cb3, 0x4ed8aa4a,
+        0x5b9cca4f, 0x682e6ff3, 0x748f82ee, 0x78a5636f, 0x84c87814, 0x8cc70208,
+        0x90befffa, 0xa4506ceb, 0xbef9a3f7, 0xc67178f2,
+    ]);
+
+    constructor() {
+        this.h = new Uint32Array([
+            0x6a09e667, 0xbb67ae85, 0x3c6ef372, 0xa54ff53a, 0x510e527f,
+            0x9b05688c, 0x1f83d9ab, 0x5be0cd19,
+        ]);
+        this.w = new Uint32Array(64);
+        this.buf = new Uint8Array(64);
+        this.bufLen = 0;
+        this.length = 0;
+    }
+
+    block(data, off) {
+        const w = this.w;
+        const K = SHA256.K;
+        for (let i = 0; i < 16; i++) {
+            const j = off + i * 4;
+            w[i] =
+                (data[j] << 24) |
+                (data[j + 1] << 16) |
+                (data[j + 2] << 8) |
+                data[j + 3];
+        }
+        for (let i = 16; i < 64; i++) {
+            const a = w[i - 15];
+            const b = w[i - 2];
+            const s0 =
+                ((a >>> 7) | (a << 25)) ^ ((a >>> 18) | (a << 14)) ^ (a >>> 3);
+            const s1 =
+                ((b >>> 17) | (b << 15)) ^ ((b >>> 19) | (b << 13)) ^ (b >>> 10);
+            w[i] = (w[i - 16] + s0 + w[i - 7] + s1) | 0;
+        }
+        let [a, b, c, d, e, f, g, h] = this.h;
+        for (let i = 0; i < 64; i++) {
+            const S1 =
+                ((e >>> 6) | (e << 26)) ^
+                ((e >>> 11) | (e << 21)) ^
+                ((e >>> 25) | (e << 7));
+            const ch = (e & f) ^ (~e & g);
+            const t1 = (h + S1 + ch + K[i] + w[i]) | 0;
+            const S0 =
+                ((a >>> 2) | (a << 30)) ^
+                ((a >>> 13) | (a << 19)) ^
+                ((a >>> 22) | (a << 10));
+            const maj = (a & b) ^ (a & c) ^ (b & c);
+            const t2 = (S0 + maj) | 0;
+            h = g;
+            g = f;
+            f = e;
+            e = (d + t1) | 0;
+            d = c;
+            c = b;
+            b = a;
+            a = (t1 + t2) | 0;
+        }
+        const hh = this.h;
+        hh[0] += a;
+        hh[1] += b;
+        hh[2] += c;
+        hh[3] += d;
+        hh[4] += e;
+        hh[5] += f;
+        hh[6] += g;
+        hh[7] += h;
+    }
+
+    update(data) {
+        let off = 0;
+        this.length += data.length;
+        if (this.bufLen > 0) {
+            const n = Math.min(64 - this.bufLen, data.length);
+            this.buf.set(data.subarray(0, n), this.bufLen);
+            this.bufLen += n;
+            off = n;
+            if (this.bufLen < 64) {
+                return;
+            }
+            this.block(this.buf, 0);
+            this.bufLen = 0;
+        }
+        for (; off + 64 <= data.length; off += 64) {
+            this.block(data, off);
+        }
+        this.buf.set(data.subarray(off), 0);
+        this.bufLen = data.length - off;
+    }
+
+    hex() {
+        const bits = this.length * 8;
+        const pad = new Uint8Array(this.bufLen < 56 ? 64 - this.bufLen : 128 - this.bufLen);
+        pad[0] = 0x80;
+        const view = new DataView(pad.buffer);
+        view.setUint32(pad.length - 8, Math.floor(bits / 0x100000000));
+        view.setUint32(pad.length - 4, bits >>> 0);
+        this.update(pad);
+        return Array.from(this.h, (x) => x.toString(16).padStart(8, '0')).join('');
+    }
+}